@@ -0,0 +1,172 @@
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/gin-gonic/gin"
+	"github.com/xhcdpg/crypto-trade/instrument"
+	"github.com/xhcdpg/crypto-trade/matching"
+	"github.com/xhcdpg/crypto-trade/types"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultDepthLevels = 20
+	maxDepthLevels     = 1000 // larger requests, and 0 for the whole book, are clamped so one request cannot walk every level
+)
+
+type Handler struct {
+	instruments *instrument.Registry
+	matching    *matching.MatchingEngine
+	publisher   message.Publisher
+	adminToken  string // bearer token required on /admin routes, which are refused when empty
+}
+
+func NewHandler(instruments *instrument.Registry, matching *matching.MatchingEngine, publisher message.Publisher, adminToken string) *Handler {
+	return &Handler{
+		instruments: instruments,
+		matching:    matching,
+		publisher:   publisher,
+		adminToken:  adminToken,
+	}
+}
+
+type tradingStateRequest struct {
+	Status types.InstrumentStatus `json:"status"`
+	Reason string                 `json:"reason"`
+}
+
+func (h *Handler) RegisterRoutes(router *gin.Engine) {
+	v1 := router.Group("/api/v1")
+	v1.GET("/instruments", h.listInstruments)
+	v1.GET("/instruments/:symbol", h.getInstrument)
+	v1.GET("/depth/:symbol", h.getDepth)
+	v1.GET("/depth/:symbol/orders", h.getOrderDepth)
+	v1.GET("/ticker/:symbol", h.getBookTicker)
+	v1.GET("/auction/:symbol", h.getAuctionPrice)
+
+	admin := v1.Group("/admin", h.adminAuth)
+	admin.POST("/instruments/:symbol/state", h.setTradingState)
+	admin.POST("/instruments/:symbol/halt", h.haltTrading)
+	admin.POST("/instruments/:symbol/resume", h.resumeTrading)
+}
+
+func (h *Handler) adminAuth(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if h.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	c.Next()
+}
+
+func (h *Handler) listInstruments(c *gin.Context) {
+	c.JSON(http.StatusOK, h.instruments.List())
+}
+
+func (h *Handler) getInstrument(c *gin.Context) {
+	instrument, err := h.instruments.Get(c.Param("symbol"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, instrument)
+}
+
+func (h *Handler) getDepth(c *gin.Context) {
+	levels, err := depthLevels(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	depth, err := h.matching.GetDepth(c.Param("symbol"), levels)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, depth)
+}
+
+func (h *Handler) getOrderDepth(c *gin.Context) {
+	levels, err := depthLevels(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	depth, err := h.matching.GetOrderDepth(c.Param("symbol"), levels)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, depth)
+}
+
+func (h *Handler) getBookTicker(c *gin.Context) {
+	ticker, err := h.matching.GetBookTicker(c.Param("symbol"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, ticker)
+}
+
+func (h *Handler) getAuctionPrice(c *gin.Context) {
+	price, err := h.matching.GetAuctionPrice(c.Param("symbol"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, price)
+}
+
+func (h *Handler) setTradingState(c *gin.Context) {
+	var req tradingStateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.changeTradingState(c, req.Status, req.Reason)
+}
+
+func (h *Handler) haltTrading(c *gin.Context) {
+	h.changeTradingState(c, types.Halted, c.DefaultQuery("reason", "halted by admin"))
+}
+
+func (h *Handler) resumeTrading(c *gin.Context) {
+	h.changeTradingState(c, types.Trading, c.DefaultQuery("reason", "resumed by admin"))
+}
+
+func (h *Handler) changeTradingState(c *gin.Context, status types.InstrumentStatus, reason string) {
+	symbol := c.Param("symbol")
+	if err := h.matching.SetTradingState(symbol, status, reason, h.publisher); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	instrument, err := h.instruments.Get(symbol)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, instrument)
+}
+
+func depthLevels(c *gin.Context) (int, error) {
+	levels := c.Query("levels")
+	if levels == "" {
+		return defaultDepthLevels, nil
+	}
+	n, err := strconv.Atoi(levels)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("levels must not be negative")
+	}
+	if n == 0 || n > maxDepthLevels {
+		return maxDepthLevels, nil
+	}
+	return n, nil
+}
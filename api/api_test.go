@@ -0,0 +1,33 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDepthLevels(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    int
+		wantErr bool
+	}{
+		{query: "", want: defaultDepthLevels},
+		{query: "levels=5", want: 5},
+		{query: "levels=0", want: maxDepthLevels},
+		{query: "levels=1000000", want: maxDepthLevels},
+		{query: "levels=-1", wantErr: true},
+		{query: "levels=abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/api/v1/depth/BTCUSDT?"+tt.query, nil)
+		levels, err := depthLevels(c)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%q: err = %v, want error %v", tt.query, err, tt.wantErr)
+		}
+		if !tt.wantErr && levels != tt.want {
+			t.Fatalf("%q: levels = %d, want %d", tt.query, levels, tt.want)
+		}
+	}
+}
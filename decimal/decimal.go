@@ -0,0 +1,371 @@
+package decimal
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// Precision is the number of fractional digits every Decimal carries.
+const Precision = 8
+
+const scale = 100000000
+
+// Decimal is a fixed-point number stored as an int64 scaled by 10^Precision,
+// so additions and comparisons are exact and never drift like float64.
+type Decimal struct {
+	value int64
+}
+
+var Zero = Decimal{}
+
+var ErrOverflow = errors.New("decimal overflow")
+
+var pow10 = [...]int64{1, 10, 100, 1000, 10000, 100000, 1000000, 10000000, 100000000}
+
+// New returns value * 10^exp, e.g. New(15, -1) is 1.5.
+func New(value int64, exp int32) Decimal {
+	if exp >= 0 {
+		return Decimal{value: mul(value, mul(scale, pow10int(exp)))}
+	}
+	if -exp > Precision {
+		return Decimal{value: roundDiv(value, pow10int(-exp-Precision))}
+	}
+	return Decimal{value: mul(value, pow10[Precision+exp])}
+}
+
+func NewFromInt(value int64) Decimal {
+	return New(value, 0)
+}
+
+// NewFromFloat converts f rounding to Precision fractional digits.
+func NewFromFloat(f float64) Decimal {
+	v := math.Round(f * scale)
+	if v > math.MaxInt64 || v < math.MinInt64 {
+		panic("decimal overflow")
+	}
+	return Decimal{value: int64(v)}
+}
+
+func NewFromString(s string) (Decimal, error) {
+	str := strings.TrimSpace(s)
+	negative := false
+	if strings.HasPrefix(str, "-") || strings.HasPrefix(str, "+") {
+		negative = str[0] == '-'
+		str = str[1:]
+	}
+
+	intPart, fracPart, _ := strings.Cut(str, ".")
+	if intPart == "" && fracPart == "" {
+		return Zero, fmt.Errorf("invalid decimal %q", s)
+	}
+	if len(fracPart) > Precision {
+		return Zero, fmt.Errorf("decimal %q has more than %d fractional digits", s, Precision)
+	}
+	for _, part := range []string{intPart, fracPart} {
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return Zero, fmt.Errorf("invalid decimal %q", s)
+			}
+		}
+	}
+
+	var integer, fraction int64
+	var err error
+	if intPart != "" {
+		if integer, err = strconv.ParseInt(intPart, 10, 64); err != nil {
+			return Zero, fmt.Errorf("invalid decimal %q: %w", s, err)
+		}
+	}
+	if fracPart != "" {
+		fracPart += strings.Repeat("0", Precision-len(fracPart))
+		if fraction, err = strconv.ParseInt(fracPart, 10, 64); err != nil {
+			return Zero, fmt.Errorf("invalid decimal %q: %w", s, err)
+		}
+	}
+	if integer > (math.MaxInt64-fraction)/scale {
+		return Zero, fmt.Errorf("decimal %q out of range", s)
+	}
+
+	value := integer*scale + fraction
+	if negative {
+		value = -value
+	}
+	return Decimal{value: value}, nil
+}
+
+// RequireFromString is like NewFromString but panics on invalid input, for constants.
+func RequireFromString(s string) Decimal {
+	d, err := NewFromString(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func (d Decimal) Add(o Decimal) Decimal {
+	sum := d.value + o.value
+	if (sum > d.value) != (o.value > 0) {
+		panic("decimal overflow")
+	}
+	return Decimal{value: sum}
+}
+
+func (d Decimal) Sub(o Decimal) Decimal {
+	return d.Add(o.Neg())
+}
+
+func (d Decimal) Neg() Decimal {
+	if d.value == math.MinInt64 {
+		panic("decimal overflow")
+	}
+	return Decimal{value: -d.value}
+}
+
+func (d Decimal) Abs() Decimal {
+	if d.value < 0 {
+		return d.Neg()
+	}
+	return d
+}
+
+// Mul returns d * o rounded half away from zero to Precision fractional digits.
+// It panics on overflow, use CheckedMul on values that are not bounded yet, e.g. order input.
+func (d Decimal) Mul(o Decimal) Decimal {
+	product, err := d.CheckedMul(o)
+	if err != nil {
+		panic(err.Error())
+	}
+	return product
+}
+
+// CheckedMul is Mul returning ErrOverflow instead of panicking.
+func (d Decimal) CheckedMul(o Decimal) (Decimal, error) {
+	hi, lo := bits.Mul64(abs(d.value), abs(o.value))
+	if hi >= scale {
+		return Zero, ErrOverflow
+	}
+	quo, rem := bits.Div64(hi, lo, scale)
+	if rem*2 >= scale {
+		quo++
+	}
+	negative := (d.value < 0) != (o.value < 0)
+	if !fits(quo, negative) {
+		return Zero, ErrOverflow
+	}
+	return Decimal{value: signed(quo, negative)}, nil
+}
+
+// Div returns d / o rounded half away from zero to Precision fractional digits.
+func (d Decimal) Div(o Decimal) Decimal {
+	if o.value == 0 {
+		panic("decimal division by zero")
+	}
+	divisor := abs(o.value)
+	hi, lo := bits.Mul64(abs(d.value), scale)
+	if hi >= divisor {
+		panic("decimal overflow")
+	}
+	quo, rem := bits.Div64(hi, lo, divisor)
+	if rem >= divisor-rem {
+		quo++
+	}
+	return Decimal{value: signed(quo, (d.value < 0) != (o.value < 0))}
+}
+
+// Round rounds half away from zero to the given number of fractional digits.
+func (d Decimal) Round(places int32) Decimal {
+	if places >= Precision {
+		return d
+	}
+	unit := pow10[Precision-clamp(places)]
+	return Decimal{value: mul(roundDiv(d.value, unit), unit)}
+}
+
+// Truncate drops fractional digits beyond places without rounding.
+func (d Decimal) Truncate(places int32) Decimal {
+	if places >= Precision {
+		return d
+	}
+	unit := pow10[Precision-clamp(places)]
+	return Decimal{value: d.value - d.value%unit}
+}
+
+// Places returns the number of fractional digits d needs, e.g. 2 for 0.01.
+func (d Decimal) Places() int32 {
+	places := int32(Precision)
+	for places > 0 && d.value%pow10[Precision-places+1] == 0 {
+		places--
+	}
+	return places
+}
+
+// IsMultipleOf reports whether d is an exact multiple of step, e.g. a tick or lot size.
+func (d Decimal) IsMultipleOf(step Decimal) bool {
+	if step.value == 0 {
+		return true
+	}
+	return d.value%step.value == 0
+}
+
+func (d Decimal) Cmp(o Decimal) int {
+	switch {
+	case d.value < o.value:
+		return -1
+	case d.value > o.value:
+		return 1
+	}
+	return 0
+}
+
+func (d Decimal) Equal(o Decimal) bool              { return d.value == o.value }
+func (d Decimal) LessThan(o Decimal) bool           { return d.value < o.value }
+func (d Decimal) LessThanOrEqual(o Decimal) bool    { return d.value <= o.value }
+func (d Decimal) GreaterThan(o Decimal) bool        { return d.value > o.value }
+func (d Decimal) GreaterThanOrEqual(o Decimal) bool { return d.value >= o.value }
+func (d Decimal) IsZero() bool                      { return d.value == 0 }
+func (d Decimal) IsPositive() bool                  { return d.value > 0 }
+func (d Decimal) IsNegative() bool                  { return d.value < 0 }
+
+func (d Decimal) Sign() int {
+	return d.Cmp(Zero)
+}
+
+func Min(a, b Decimal) Decimal {
+	if a.value < b.value {
+		return a
+	}
+	return b
+}
+
+func Max(a, b Decimal) Decimal {
+	if a.value > b.value {
+		return a
+	}
+	return b
+}
+
+// Float64 is lossy and only meant for display or statistics, never for bookkeeping.
+func (d Decimal) Float64() float64 {
+	return float64(d.value) / scale
+}
+
+func (d Decimal) String() string {
+	u := abs(d.value)
+	str := strconv.FormatUint(u/scale, 10)
+	if frac := u % scale; frac != 0 {
+		str += "." + strings.TrimRight(fmt.Sprintf("%08d", frac), "0")
+	}
+	if d.value < 0 {
+		str = "-" + str
+	}
+	return str
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.String())), nil
+}
+
+// UnmarshalJSON accepts both quoted strings and bare JSON numbers.
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	str := string(data)
+	if str == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(str); err == nil {
+		str = unquoted
+	}
+	parsed, err := NewFromString(str)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+func (d *Decimal) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*d = Zero
+	case int64:
+		*d = NewFromInt(v)
+	case float64:
+		*d = NewFromFloat(v)
+	case []byte:
+		return d.Scan(string(v))
+	case string:
+		parsed, err := NewFromString(v)
+		if err != nil {
+			return err
+		}
+		*d = parsed
+	default:
+		return errors.New("unsupported decimal source type")
+	}
+	return nil
+}
+
+func (d Decimal) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+func abs(v int64) uint64 {
+	if v < 0 {
+		return uint64(-(v + 1)) + 1
+	}
+	return uint64(v)
+}
+
+// fits reports whether a magnitude with the given sign fits an int64, which holds one more negative value.
+func fits(u uint64, negative bool) bool {
+	return u <= math.MaxInt64 || negative && u == 1<<63
+}
+
+func signed(u uint64, negative bool) int64 {
+	if !fits(u, negative) {
+		panic("decimal overflow")
+	}
+	if negative {
+		return int64(-u)
+	}
+	return int64(u)
+}
+
+func mul(a, b int64) int64 {
+	hi, lo := bits.Mul64(abs(a), abs(b))
+	if hi != 0 {
+		panic("decimal overflow")
+	}
+	return signed(lo, (a < 0) != (b < 0))
+}
+
+func roundDiv(v, unit int64) int64 {
+	q, r := v/unit, v%unit
+	if abs(r)*2 >= uint64(unit) {
+		if v < 0 {
+			q--
+		} else {
+			q++
+		}
+	}
+	return q
+}
+
+func pow10int(exp int32) int64 {
+	result := int64(1)
+	for i := int32(0); i < exp; i++ {
+		result = mul(result, 10)
+	}
+	return result
+}
+
+func clamp(places int32) int32 {
+	if places < 0 {
+		return 0
+	}
+	return places
+}
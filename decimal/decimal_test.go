@@ -0,0 +1,152 @@
+package decimal
+
+import (
+	"math"
+	"testing"
+)
+
+var (
+	maxDecimal = Decimal{value: math.MaxInt64}
+	minDecimal = Decimal{value: math.MinInt64}
+	smallest   = Decimal{value: 1}
+)
+
+func TestArithmetic(t *testing.T) {
+	tests := []struct {
+		name string
+		got  func() Decimal
+		want string
+	}{
+		{"add", func() Decimal { return RequireFromString("1.5").Add(RequireFromString("-2.25")) }, "-0.75"},
+		{"sub", func() Decimal { return RequireFromString("-1.5").Sub(RequireFromString("0.00000001")) }, "-1.50000001"},
+		{"mul", func() Decimal { return RequireFromString("1.5").Mul(RequireFromString("-2")) }, "-3"},
+		{"mul both negative", func() Decimal { return RequireFromString("-1.5").Mul(RequireFromString("-2")) }, "3"},
+		{"mul rounds half up", func() Decimal { return smallest.Mul(RequireFromString("0.5")) }, "0.00000001"},
+		{"mul rounds half away from zero", func() Decimal { return smallest.Neg().Mul(RequireFromString("0.5")) }, "-0.00000001"},
+		{"mul rounds down below half", func() Decimal { return smallest.Mul(RequireFromString("0.49999999")) }, "0"},
+		{"div", func() Decimal { return RequireFromString("1").Div(RequireFromString("3")) }, "0.33333333"},
+		{"div rounds up", func() Decimal { return RequireFromString("2").Div(RequireFromString("3")) }, "0.66666667"},
+		{"div rounds half away from zero", func() Decimal { return smallest.Neg().Div(RequireFromString("2")) }, "-0.00000001"},
+		{"div negative divisor", func() Decimal { return RequireFromString("2").Div(RequireFromString("-3")) }, "-0.66666667"},
+		{"round half up", func() Decimal { return RequireFromString("1.25").Round(1) }, "1.3"},
+		{"round half away from zero", func() Decimal { return RequireFromString("-1.25").Round(1) }, "-1.3"},
+		{"round down", func() Decimal { return RequireFromString("-1.24").Round(1) }, "-1.2"},
+		{"round to integer", func() Decimal { return RequireFromString("-2.5").Round(0) }, "-3"},
+		{"round negative places", func() Decimal { return RequireFromString("2.5").Round(-1) }, "3"},
+		{"truncate toward zero", func() Decimal { return RequireFromString("-1.59").Truncate(1) }, "-1.5"},
+		{"new negative exponent", func() Decimal { return New(15, -1) }, "1.5"},
+		{"new rounds beyond precision", func() Decimal { return New(-15, -9) }, "-0.00000002"},
+		{"min int64 string", func() Decimal { return minDecimal }, "-92233720368.54775808"},
+		{"min int64 times one", func() Decimal { return minDecimal.Mul(RequireFromString("1")) }, "-92233720368.54775808"},
+		{"min int64 divided by one", func() Decimal { return minDecimal.Div(RequireFromString("1")) }, "-92233720368.54775808"},
+		{"min int64 rounded", func() Decimal { return minDecimal.Round(Precision) }, "-92233720368.54775808"},
+		{"max int64 abs of neg", func() Decimal { return maxDecimal.Neg().Abs() }, "92233720368.54775807"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.got().String(); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func()
+	}{
+		{"add", func() { maxDecimal.Add(smallest) }},
+		{"sub", func() { minDecimal.Sub(smallest) }},
+		{"neg min int64", func() { minDecimal.Neg() }},
+		{"abs min int64", func() { minDecimal.Abs() }},
+		{"mul", func() { maxDecimal.Mul(RequireFromString("2")) }},
+		{"mul by rounding", func() { maxDecimal.Mul(RequireFromString("1.00000001")) }},
+		{"mul min int64 by minus one", func() { minDecimal.Mul(RequireFromString("-1")) }},
+		{"div", func() { maxDecimal.Div(RequireFromString("0.5")) }},
+		{"div min int64 by minus one", func() { minDecimal.Div(RequireFromString("-1")) }},
+		{"div by zero", func() { smallest.Div(Zero) }},
+		{"round", func() { maxDecimal.Round(0) }},
+		{"round min int64", func() { minDecimal.Round(0) }},
+		{"new", func() { New(1, 11) }},
+		{"float", func() { NewFromFloat(1e11) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("no panic")
+				}
+			}()
+			tt.op()
+		})
+	}
+}
+
+func TestCheckedMul(t *testing.T) {
+	tests := []struct {
+		a, b    Decimal
+		want    string
+		wantErr bool
+	}{
+		{RequireFromString("1000000"), RequireFromString("90000"), "90000000000", false},
+		{RequireFromString("1000000"), RequireFromString("100000"), "", true},
+		{maxDecimal, RequireFromString("-1"), "-92233720368.54775807", false},
+		{minDecimal, RequireFromString("-1"), "", true},
+		{minDecimal, RequireFromString("0.5"), "-46116860184.27387904", false},
+	}
+	for _, tt := range tests {
+		got, err := tt.a.CheckedMul(tt.b)
+		if tt.wantErr {
+			if err != ErrOverflow {
+				t.Errorf("%s * %s: got %s, %v, want %v", tt.a, tt.b, got, err, ErrOverflow)
+			}
+			continue
+		}
+		if err != nil || got.String() != tt.want {
+			t.Errorf("%s * %s: got %s, %v, want %s", tt.a, tt.b, got, err, tt.want)
+		}
+	}
+}
+
+func TestNewFromString(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"1.5", "1.5", false},
+		{"-0.00000001", "-0.00000001", false},
+		{"+2", "2", false},
+		{".5", "0.5", false},
+		{"92233720368.54775807", "92233720368.54775807", false},
+		{"92233720368.54775808", "", true},
+		{"0.000000001", "", true},
+		{"1e5", "", true},
+		{"-", "", true},
+	}
+	for _, tt := range tests {
+		got, err := NewFromString(tt.in)
+		if (err != nil) != tt.wantErr || err == nil && got.String() != tt.want {
+			t.Errorf("NewFromString(%q) = %s, %v, want %s", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestPlaces(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int32
+	}{
+		{"0", 0},
+		{"100", 0},
+		{"0.1", 1},
+		{"-2.05", 2},
+		{"0.00000001", 8},
+	}
+	for _, tt := range tests {
+		if got := RequireFromString(tt.in).Places(); got != tt.want {
+			t.Errorf("%s has %d places, want %d", tt.in, got, tt.want)
+		}
+	}
+}
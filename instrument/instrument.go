@@ -0,0 +1,260 @@
+package instrument
+
+import (
+	"errors"
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/types"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+type Registry struct {
+	instruments map[string]*models.Instrument
+	mutex       sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		instruments: make(map[string]*models.Instrument),
+	}
+}
+
+func (r *Registry) Register(instrument *models.Instrument) error {
+	if instrument.Symbol == "" {
+		return errors.New("instrument symbol is required")
+	}
+	if !instrument.TickSize.IsPositive() || !instrument.LotSize.IsPositive() {
+		return errors.New("tick size and lot size must be positive")
+	}
+	if instrument.PricePrecision == 0 {
+		instrument.PricePrecision = instrument.TickSize.Places()
+	}
+	if instrument.QuantityPrecision == 0 {
+		instrument.QuantityPrecision = instrument.LotSize.Places()
+	}
+	if instrument.PricePrecision < 0 || instrument.PricePrecision > decimal.Precision ||
+		instrument.QuantityPrecision < 0 || instrument.QuantityPrecision > decimal.Precision {
+		return errors.New("price and quantity precision must be between 0 and " + strconv.Itoa(decimal.Precision))
+	}
+	if instrument.TickSize.Places() > instrument.PricePrecision || instrument.LotSize.Places() > instrument.QuantityPrecision {
+		return errors.New("tick size and lot size must fit the price and quantity precision")
+	}
+	if instrument.MaxNotional.IsZero() {
+		instrument.MaxNotional = DefaultMaxNotional
+	}
+	if !instrument.MaxNotional.IsPositive() || instrument.MaxNotional.GreaterThan(notionalLimit) ||
+		instrument.MaxNotional.LessThan(instrument.MinNotional) {
+		return errors.New("max notional must be between min notional and " + notionalLimit.String())
+	}
+	if !instrument.MaxQuantity.IsZero() && instrument.MaxQuantity.LessThan(instrument.MinQuantity) {
+		return errors.New("max quantity must not be less than min quantity")
+	}
+	if instrument.MaxLeverage == 0 {
+		return errors.New("max leverage must be at least 1")
+	}
+	one := decimal.NewFromInt(1)
+	if instrument.MaxSlippage.IsNegative() || instrument.MaxSlippage.GreaterThanOrEqual(one) ||
+		instrument.PriceBand.IsNegative() || instrument.PriceBand.GreaterThanOrEqual(one) {
+		return errors.New("max slippage and price band must be between 0 and 1")
+	}
+	if instrument.CircuitBreakerPercent.IsNegative() ||
+		instrument.CircuitBreakerPercent.IsPositive() && instrument.CircuitBreakerWindow == 0 {
+		return errors.New("circuit breaker requires a positive percent and window")
+	}
+	if instrument.Status == "" {
+		instrument.Status = types.Trading
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.instruments[instrument.Symbol] = instrument
+	return nil
+}
+
+func (r *Registry) Get(symbol string) (*models.Instrument, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if instrument, ok := r.instruments[symbol]; ok {
+		return instrument, nil
+	}
+	return nil, errors.New("unknown symbol: " + symbol)
+}
+
+func (r *Registry) List() []*models.Instrument {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	instruments := make([]*models.Instrument, 0, len(r.instruments))
+	for _, instrument := range r.instruments {
+		instruments = append(instruments, instrument)
+	}
+	sort.Slice(instruments, func(i, j int) bool {
+		return instruments[i].Symbol < instruments[j].Symbol
+	})
+	return instruments
+}
+
+func (r *Registry) SetStatus(symbol string, status types.InstrumentStatus) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	instrument, ok := r.instruments[symbol]
+	if !ok {
+		return errors.New("unknown symbol: " + symbol)
+	}
+	// instruments returned by Get are read without the lock, replace instead of mutating
+	updated := *instrument
+	updated.Status = status
+	r.instruments[symbol] = &updated
+	return nil
+}
+
+// CanCancel reports whether orders of an instrument in the given status may be cancelled.
+func CanCancel(status types.InstrumentStatus) bool {
+	return status == types.Trading || status == types.CancelOnly || status == types.Auction
+}
+
+// ValidateOrder checks an order against the instrument's trading rules. entryPrice is the
+// price the order is expected to execute at and is used for the min notional check.
+func ValidateOrder(instrument *models.Instrument, order *models.Order, entryPrice decimal.Decimal) error {
+	switch instrument.Status {
+	case types.Trading:
+	case types.Auction:
+		// auction orders wait for the uncross, orders that cannot rest have nothing to match
+		if order.Type == types.Market || order.TimeInForce == types.IOC || order.TimeInForce == types.FOK {
+			return errors.New("only orders that can rest are accepted during an auction")
+		}
+	default:
+		return errors.New("symbol is not trading: " + string(instrument.Status))
+	}
+
+	if !order.Quantity.IsPositive() {
+		return errors.New("quantity must be positive")
+	}
+	if !order.Quantity.IsMultipleOf(instrument.LotSize) {
+		return errors.New("quantity is not a multiple of lot size " + instrument.LotSize.String())
+	}
+	if order.Quantity.LessThan(instrument.MinQuantity) {
+		return errors.New("quantity is below min quantity " + instrument.MinQuantity.String())
+	}
+	if !instrument.MaxQuantity.IsZero() && order.Quantity.GreaterThan(instrument.MaxQuantity) {
+		return errors.New("quantity is above max quantity " + instrument.MaxQuantity.String())
+	}
+
+	if !order.DisplayQuantity.IsZero() {
+		if order.Type != types.Limit {
+			return errors.New("display quantity is only supported on limit orders")
+		}
+		if order.TimeInForce == types.IOC || order.TimeInForce == types.FOK {
+			return errors.New("display quantity requires an order that can rest on the book")
+		}
+		if !order.DisplayQuantity.IsPositive() || !order.DisplayQuantity.IsMultipleOf(instrument.LotSize) ||
+			order.DisplayQuantity.LessThan(instrument.MinQuantity) || order.DisplayQuantity.GreaterThan(order.Quantity) {
+			return errors.New("display quantity must be a multiple of lot size between min quantity and quantity")
+		}
+	}
+
+	switch order.Type {
+	case types.Limit, types.LimitStopLoss, types.LimitTakeProfit:
+		if !order.Price.IsPositive() || !order.Price.IsMultipleOf(instrument.TickSize) {
+			return errors.New("price must be a positive multiple of tick size " + instrument.TickSize.String())
+		}
+	}
+	switch order.Type {
+	case types.LimitStopLoss, types.LimitTakeProfit, types.MarketStopLoss, types.MarketTakeProfit:
+		if !order.StopPrice.IsPositive() || !order.StopPrice.IsMultipleOf(instrument.TickSize) {
+			return errors.New("stop price must be a positive multiple of tick size " + instrument.TickSize.String())
+		}
+	}
+
+	if order.Type == types.TrailingStop {
+		if err := validateTrailingStop(instrument, order); err != nil {
+			return err
+		}
+	}
+
+	if err := checkNotional(instrument, order, entryPrice); err != nil {
+		return err
+	}
+
+	if order.Leverage == 0 || order.Leverage > instrument.MaxLeverage {
+		return errors.New("leverage must be between 1 and max leverage")
+	}
+	return nil
+}
+
+var (
+	// DefaultMaxNotional is the max notional of an order on instruments that do not set one.
+	DefaultMaxNotional = decimal.NewFromInt(1000000000)
+	// notionalLimit bounds every max notional far below the range of decimal.Decimal, so the
+	// arithmetic on fills, average prices, margins and positions cannot overflow.
+	notionalLimit = decimal.NewFromInt(10000000000)
+)
+
+// checkNotional checks the notional of the order at the entry price, and at its limit price
+// which bounds what it may fill at.
+func checkNotional(instrument *models.Instrument, order *models.Order, entryPrice decimal.Decimal) error {
+	for _, price := range []decimal.Decimal{entryPrice, order.Price} {
+		if price.IsZero() {
+			continue
+		}
+		notional, err := order.Quantity.CheckedMul(price)
+		if err != nil || notional.GreaterThan(instrument.MaxNotional) {
+			return errors.New("order notional is above max notional " + instrument.MaxNotional.String())
+		}
+	}
+	if !entryPrice.IsZero() && order.Quantity.Mul(entryPrice).LessThan(instrument.MinNotional) {
+		return errors.New("order notional is below min notional " + instrument.MinNotional.String())
+	}
+	return nil
+}
+
+func validateTrailingStop(instrument *models.Instrument, order *models.Order) error {
+	if order.CallbackRate.IsZero() == order.TrailingDelta.IsZero() {
+		return errors.New("trailing stop requires either a callback rate or a trailing delta")
+	}
+	if !order.CallbackRate.IsZero() && (!order.CallbackRate.IsPositive() || order.CallbackRate.GreaterThanOrEqual(decimal.NewFromInt(1))) {
+		return errors.New("callback rate must be between 0 and 1")
+	}
+	if !order.TrailingDelta.IsZero() && (!order.TrailingDelta.IsPositive() || !order.TrailingDelta.IsMultipleOf(instrument.TickSize)) {
+		return errors.New("trailing delta must be a positive multiple of tick size " + instrument.TickSize.String())
+	}
+	if order.ActivationPrice.IsNegative() || !order.ActivationPrice.IsMultipleOf(instrument.TickSize) {
+		return errors.New("activation price must be a multiple of tick size " + instrument.TickSize.String())
+	}
+	return nil
+}
+
+// MarketPriceLimit returns the worst price a market order may fill at given the reference
+// price it arrives at, rounded to the tick size towards the reference. It returns zero when
+// the instrument has no slippage limit or there is no reference price.
+func MarketPriceLimit(instrument *models.Instrument, side types.Side, reference decimal.Decimal) decimal.Decimal {
+	if instrument.MaxSlippage.IsZero() || !reference.IsPositive() {
+		return decimal.Zero
+	}
+
+	one := decimal.NewFromInt(1)
+	if side == types.Buy {
+		limit := reference.Mul(one.Add(instrument.MaxSlippage))
+		return limit.Div(instrument.TickSize).Truncate(0).Mul(instrument.TickSize)
+	}
+	limit := reference.Mul(one.Sub(instrument.MaxSlippage))
+	rounded := limit.Div(instrument.TickSize).Truncate(0).Mul(instrument.TickSize)
+	if rounded.LessThan(limit) {
+		rounded = rounded.Add(instrument.TickSize)
+	}
+	return rounded
+}
+
+// CheckPriceBand rejects a limit price further from the reference price than the price band
+// of the instrument allows. No reference price disables the check.
+func CheckPriceBand(instrument *models.Instrument, price, reference decimal.Decimal) error {
+	if instrument.PriceBand.IsZero() || !reference.IsPositive() {
+		return nil
+	}
+	if price.Sub(reference).Abs().Div(reference).GreaterThan(instrument.PriceBand) {
+		return errors.New("price is more than " + instrument.PriceBand.Mul(decimal.NewFromInt(100)).String() + "% away from " + reference.String())
+	}
+	return nil
+}
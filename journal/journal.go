@@ -0,0 +1,233 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EntryType string
+
+const (
+	Place      EntryType = "place"
+	Cancel     EntryType = "cancel"
+	CancelAll  EntryType = "cancel_all"
+	Amend      EntryType = "amend"
+	Trigger    EntryType = "trigger"
+	Expire     EntryType = "expire"
+	Trail      EntryType = "trail"
+	PlaceGroup EntryType = "place_group"
+	Auction    EntryType = "auction"
+	Uncross    EntryType = "uncross"
+	Clip       EntryType = "clip"
+	State      EntryType = "state"
+	Activate   EntryType = "activate" // a bracket leg activated for Quantity, zero when it was refused
+)
+
+// Entry is one command accepted by the matching engine for a symbol. Entries carry
+// everything needed to apply the command again, so replaying them in sequence order
+// rebuilds the order book exactly.
+type Entry struct {
+	Symbol    string          `json:"symbol"`
+	Sequence  uint64          `json:"sequence"`
+	Type      EntryType       `json:"type"`
+	Order     *models.Order   `json:"order,omitempty"`
+	Orders    []*models.Order `json:"orders,omitempty"`
+	OrderID   string          `json:"order_id,omitempty"`
+	UserID    string          `json:"user_id,omitempty"`
+	Price     decimal.Decimal `json:"price"`
+	StopPrice decimal.Decimal `json:"stop_price"`
+	Quantity  decimal.Decimal `json:"quantity"`
+	Filled    decimal.Decimal `json:"filled"`
+	Time      time.Time       `json:"time"`
+	// Status is the trading state a state entry moves the symbol to.
+	Status types.InstrumentStatus `json:"status,omitempty"`
+}
+
+type Journal interface {
+	Append(entry *Entry) error
+	// Read returns the entries of a symbol with a sequence number greater than afterSequence.
+	Read(symbol string, afterSequence uint64) ([]*Entry, error)
+	// Truncate drops the entries of a symbol up to and including throughSequence,
+	// once they are covered by a snapshot.
+	Truncate(symbol string, throughSequence uint64) error
+	Symbols() ([]string, error)
+}
+
+// FileJournal keeps one append-only file of JSON lines per symbol and syncs every append to disk.
+// Each symbol has its own lock, so books appending to different symbols sync in parallel.
+type FileJournal struct {
+	dir   string
+	files map[string]*symbolFile
+	mutex sync.Mutex // guards files
+}
+
+type symbolFile struct {
+	file  *os.File // opened on first append
+	mutex sync.Mutex
+}
+
+const fileExt = ".journal"
+
+func NewFileJournal(dir string) (*FileJournal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileJournal{
+		dir:   dir,
+		files: make(map[string]*symbolFile),
+	}, nil
+}
+
+func (j *FileJournal) Append(entry *Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	sf := j.getFile(entry.Symbol)
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+	if sf.file == nil {
+		if sf.file, err = os.OpenFile(j.path(entry.Symbol), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+			return err
+		}
+	}
+	if _, err := sf.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return sf.file.Sync()
+}
+
+func (j *FileJournal) Read(symbol string, afterSequence uint64) ([]*Entry, error) {
+	sf := j.getFile(symbol)
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+	return j.read(symbol, afterSequence)
+}
+
+func (j *FileJournal) Truncate(symbol string, throughSequence uint64) error {
+	sf := j.getFile(symbol)
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+
+	entries, err := j.read(symbol, throughSequence)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(j.dir, symbol+fileExt+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	writer := bufio.NewWriter(tmp)
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		writer.Write(append(data, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if sf.file != nil {
+		sf.file.Close()
+		sf.file = nil
+	}
+	return os.Rename(tmp.Name(), j.path(symbol))
+}
+
+func (j *FileJournal) read(symbol string, afterSequence uint64) ([]*Entry, error) {
+	file, err := os.Open(j.path(symbol))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []*Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		if entry.Sequence > afterSequence {
+			entries = append(entries, &entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func (j *FileJournal) Symbols() ([]string, error) {
+	files, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var symbols []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), fileExt) {
+			symbols = append(symbols, strings.TrimSuffix(file.Name(), fileExt))
+		}
+	}
+	sort.Strings(symbols)
+	return symbols, nil
+}
+
+func (j *FileJournal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	var err error
+	for _, sf := range j.files {
+		sf.mutex.Lock()
+		if sf.file != nil {
+			if closeErr := sf.file.Close(); closeErr != nil {
+				err = closeErr
+			}
+			sf.file = nil
+		}
+		sf.mutex.Unlock()
+	}
+	return err
+}
+
+func (j *FileJournal) getFile(symbol string) *symbolFile {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	sf, ok := j.files[symbol]
+	if !ok {
+		sf = &symbolFile{}
+		j.files[symbol] = sf
+	}
+	return sf
+}
+
+func (j *FileJournal) path(symbol string) string {
+	return filepath.Join(j.dir, symbol+fileExt)
+}
@@ -5,6 +5,8 @@ import (
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
+	"github.com/xhcdpg/crypto-trade/api"
+	"github.com/xhcdpg/crypto-trade/instrument"
 	"github.com/xhcdpg/crypto-trade/matching"
 	"github.com/xhcdpg/crypto-trade/position"
 	"github.com/xhcdpg/crypto-trade/risk"
@@ -17,16 +19,19 @@ type Config struct {
 	RedisURL    string
 	AmqpURL     string
 	HttpPort    string
+	AdminToken  string
 }
 
 type App struct {
-	db        *sql.DB
-	redis     *redis.Client
-	pubSub    message.Publisher
-	matching  *matching.MatchingEngine
-	risk      *risk.RiskManager
-	position  *position.PositionManager
-	user      *u.UserService
-	websocket *websocket.WebsocketService
-	router    *gin.Engine
+	db          *sql.DB
+	redis       *redis.Client
+	pubSub      message.Publisher
+	instruments *instrument.Registry
+	matching    *matching.MatchingEngine
+	risk        *risk.RiskManager
+	position    *position.PositionManager
+	user        *u.UserService
+	websocket   *websocket.WebsocketService
+	api         *api.Handler
+	router      *gin.Engine
 }
@@ -0,0 +1,229 @@
+package matching
+
+import (
+	"encoding/json"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/journal"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/types"
+	"time"
+)
+
+// StartAuction stops continuous matching on the symbol: limit orders are collected without
+// matching and the indicative price is published on "auction_indicative" as it changes.
+func (m *MatchingEngine) StartAuction(symbol, reason string, publisher message.Publisher) error {
+	return m.SetTradingState(symbol, types.Auction, reason, publisher)
+}
+
+// EndAuction uncrosses the collected orders at the equilibrium price, publishes the result
+// on "auction_uncrossed" and resumes continuous trading.
+func (m *MatchingEngine) EndAuction(symbol string, publisher message.Publisher) error {
+	return m.SetTradingState(symbol, types.Trading, "auction ended", publisher)
+}
+
+// GetAuctionPrice returns the price and volume the book would uncross at now.
+func (m *MatchingEngine) GetAuctionPrice(symbol string) (*models.AuctionPrice, error) {
+	var price *models.AuctionPrice
+	err := m.submit(symbol, &command{kind: queryCommand, query: func(ob *OrderBook) {
+		price = ob.auctionPrice()
+	}})
+	return price, err
+}
+
+func (m *MatchingEngine) startAuction(ob *OrderBook) error {
+	if ob.auction {
+		return nil
+	}
+	if err := m.record(ob, &journal.Entry{Type: journal.Auction}); err != nil {
+		return err
+	}
+	ob.auction = true
+	ob.indicative = nil
+	return nil
+}
+
+// startListingAuction starts the auction of a book whose instrument was registered in auction status.
+func (m *MatchingEngine) startListingAuction(ob *OrderBook) error {
+	inst, err := m.instruments.Get(ob.Symbol)
+	if err != nil || inst.Status != types.Auction {
+		return err
+	}
+	return m.startAuction(ob)
+}
+
+func (m *MatchingEngine) endAuction(ob *OrderBook, publisher message.Publisher) error {
+	if !ob.auction {
+		return nil
+	}
+	if err := m.record(ob, &journal.Entry{Type: journal.Uncross}); err != nil {
+		return err
+	}
+	return m.uncross(ob, publisher)
+}
+
+// uncross executes every crossing order at the equilibrium price in price-time priority
+// and ends the auction. It only depends on the book, so replay uncrosses the same way.
+// When the two orders of a trade must not trade with each other, the newer one is cancelled.
+func (m *MatchingEngine) uncross(ob *OrderBook, publisher message.Publisher) error {
+	result := ob.auctionPrice()
+	ob.auction = false
+	ob.indicative = nil
+
+	volume := decimal.Zero
+	for !result.Volume.IsZero() && ob.Bids.Len() > 0 && ob.Asks.Len() > 0 {
+		bid, ask := ob.Bids.Front(), ob.Asks.Front()
+		if bid.Price.LessThan(result.Price) || ask.Price.GreaterThan(result.Price) {
+			break
+		}
+
+		taker, maker := bid, ask
+		if ask.Timestamp.After(bid.Timestamp) {
+			taker, maker = ask, bid
+		}
+		if isSelfTrade(taker.Order, maker) {
+			if err := removeAndCancel(ob, taker.Order, publisher); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := m.clipClosing(ob, bid.Order, publisher); err != nil {
+			return err
+		}
+		if err := m.clipClosing(ob, ask.Order, publisher); err != nil {
+			return err
+		}
+		if bid.Order.Status == types.Cancelled || ask.Order.Status == types.Cancelled {
+			continue
+		}
+
+		quantity := decimal.Min(bid.Quantity, ask.Quantity)
+		trade := &models.Trade{
+			ID:        uuid.New().String(),
+			Symbol:    ob.Symbol,
+			BuyerID:   bid.UserID,
+			SellerID:  ask.UserID,
+			Price:     result.Price,
+			Quantity:  quantity,
+			Timestamp: time.Now(),
+		}
+		ob.fillResting(bid, quantity, result.Price)
+		ob.fillResting(ask, quantity, result.Price)
+		if err := m.settleTrade(ob, trade, taker.Order, maker, publisher); err != nil {
+			return err
+		}
+		volume = volume.Add(quantity)
+	}
+
+	result.Volume = volume
+	return publishAuctionPrice("auction_uncrossed", result, publisher)
+}
+
+// publishIndicative publishes the equilibrium of an auction book when it changed since the last command.
+func (m *MatchingEngine) publishIndicative(ob *OrderBook, publisher message.Publisher) error {
+	if !ob.auction || publisher == nil {
+		return nil
+	}
+	price := ob.auctionPrice()
+	if last := ob.indicative; last != nil && last.Price.Equal(price.Price) &&
+		last.Volume.Equal(price.Volume) && last.Surplus.Equal(price.Surplus) {
+		return nil
+	}
+	ob.indicative = price
+	return publishAuctionPrice("auction_indicative", price, publisher)
+}
+
+func publishAuctionPrice(topic string, price *models.AuctionPrice, publisher message.Publisher) error {
+	priceJson, err := json.Marshal(price)
+	if err != nil {
+		return err
+	}
+	return publisher.Publish(topic, message.NewMessage(uuid.New().String(), priceJson))
+}
+
+type auctionLevel struct {
+	price    decimal.Decimal
+	quantity decimal.Decimal
+}
+
+// auctionLevels returns the levels of a side in ascending price order with their full
+// remaining quantity, hidden iceberg reserves included.
+func auctionLevels(side *BookSide) []auctionLevel {
+	levels := make([]auctionLevel, 0, side.Levels())
+	side.Each(func(level *PriceLevel) bool {
+		quantity := decimal.Zero
+		for _, node := range level.Orders() {
+			quantity = quantity.Add(remainingQuantity(node.Order))
+		}
+		levels = append(levels, auctionLevel{price: level.Price, quantity: quantity})
+		return true
+	})
+	if side.descending {
+		for i, j := 0, len(levels)-1; i < j; i, j = i+1, j-1 {
+			levels[i], levels[j] = levels[j], levels[i]
+		}
+	}
+	return levels
+}
+
+// auctionPrice finds the equilibrium of the book: among the limit prices of both sides, the one
+// executing the most volume, then leaving the smallest surplus, then closest to the last price,
+// then the lowest. The volume is zero when the book does not cross.
+func (ob *OrderBook) auctionPrice() *models.AuctionPrice {
+	result := &models.AuctionPrice{Symbol: ob.Symbol, Sequence: ob.Sequence, Timestamp: time.Now()}
+	bids, asks := auctionLevels(ob.Bids), auctionLevels(ob.Asks)
+
+	totalBuy := decimal.Zero
+	for _, level := range bids {
+		totalBuy = totalBuy.Add(level.quantity)
+	}
+
+	var (
+		buyBelow, sell decimal.Decimal
+		i, j           int
+	)
+	for i < len(bids) || j < len(asks) {
+		// walk the candidate prices of both sides in ascending order
+		var price decimal.Decimal
+		if j >= len(asks) || i < len(bids) && bids[i].price.LessThan(asks[j].price) {
+			price = bids[i].price
+		} else {
+			price = asks[j].price
+		}
+		for ; j < len(asks) && asks[j].price.LessThanOrEqual(price); j++ {
+			sell = sell.Add(asks[j].quantity)
+		}
+		buy := totalBuy.Sub(buyBelow)
+		for ; i < len(bids) && bids[i].price.Equal(price); i++ {
+			buyBelow = buyBelow.Add(bids[i].quantity)
+		}
+
+		volume := decimal.Min(buy, sell)
+		if !volume.IsPositive() {
+			continue
+		}
+		surplus := buy.Sub(sell)
+		if result.Volume.IsZero() || betterAuctionPrice(ob.LastPrice, result, price, volume, surplus) {
+			result.Price, result.Volume, result.Surplus = price, volume, surplus
+		}
+	}
+	return result
+}
+
+func betterAuctionPrice(reference decimal.Decimal, best *models.AuctionPrice, price, volume, surplus decimal.Decimal) bool {
+	if !volume.Equal(best.Volume) {
+		return volume.GreaterThan(best.Volume)
+	}
+	if !surplus.Abs().Equal(best.Surplus.Abs()) {
+		return surplus.Abs().LessThan(best.Surplus.Abs())
+	}
+	if !reference.IsZero() {
+		distance, bestDistance := price.Sub(reference).Abs(), best.Price.Sub(reference).Abs()
+		if !distance.Equal(bestDistance) {
+			return distance.LessThan(bestDistance)
+		}
+	}
+	// candidates are visited in ascending order, keep the lowest
+	return false
+}
@@ -0,0 +1,237 @@
+package matching
+
+import (
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"math/rand"
+)
+
+const (
+	maxSkipLevel     = 32
+	skipLevelPercent = 4 // one in skipLevelPercent nodes is promoted to the next level
+)
+
+// PriceLevel holds the resting orders of one price in time priority.
+type PriceLevel struct {
+	Price    decimal.Decimal
+	Quantity decimal.Decimal // 该价位剩余总量
+	front    *OrderNode      // oldest order, the queue is linked through the orders themselves
+	back     *OrderNode
+	count    int
+	next     []*PriceLevel
+}
+
+func (l *PriceLevel) Len() int { return l.count }
+
+// Front returns the oldest order of the level.
+func (l *PriceLevel) Front() *OrderNode {
+	return l.front
+}
+
+// Orders returns the orders of the level in time priority.
+func (l *PriceLevel) Orders() []*OrderNode {
+	nodes := make([]*OrderNode, 0, l.count)
+	for node := l.front; node != nil; node = node.next {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func (l *PriceLevel) pushBack(node *OrderNode) {
+	node.prev, node.next = l.back, nil
+	if l.back != nil {
+		l.back.next = node
+	} else {
+		l.front = node
+	}
+	l.back = node
+	l.count++
+}
+
+func (l *PriceLevel) remove(node *OrderNode) {
+	if node.prev != nil {
+		node.prev.next = node.next
+	} else {
+		l.front = node.next
+	}
+	if node.next != nil {
+		node.next.prev = node.prev
+	} else {
+		l.back = node.prev
+	}
+	node.prev, node.next = nil, nil
+	l.count--
+}
+
+// BookSide is one side of an order book: a skip list of price levels ordered best
+// first, each keeping its orders in a FIFO queue linked through the orders, so they
+// can be added and removed without allocating or searching the level. Levels are
+// also indexed by price, so orders joining an existing level skip the list search.
+type BookSide struct {
+	descending bool // bids are ordered from the highest price
+	head       *PriceLevel
+	byPrice    map[decimal.Decimal]*PriceLevel
+	level      int
+	orders     int
+	random     *rand.Rand
+}
+
+func NewBookSide(descending bool) *BookSide {
+	return &BookSide{
+		descending: descending,
+		head:       &PriceLevel{next: make([]*PriceLevel, maxSkipLevel)},
+		byPrice:    make(map[decimal.Decimal]*PriceLevel),
+		level:      1,
+		random:     rand.New(rand.NewSource(1)),
+	}
+}
+
+// Len returns the number of resting orders.
+func (s *BookSide) Len() int { return s.orders }
+
+// Levels returns the number of price levels.
+func (s *BookSide) Levels() int { return len(s.byPrice) }
+
+// Best returns the best price level, or nil if the side is empty.
+func (s *BookSide) Best() *PriceLevel {
+	return s.head.next[0]
+}
+
+// BestPrice returns the best price, or zero if the side is empty.
+func (s *BookSide) BestPrice() decimal.Decimal {
+	if best := s.Best(); best != nil {
+		return best.Price
+	}
+	return decimal.Zero
+}
+
+// Front returns the order with the highest priority, or nil if the side is empty.
+func (s *BookSide) Front() *OrderNode {
+	if best := s.Best(); best != nil {
+		return best.Front()
+	}
+	return nil
+}
+
+// Each calls fn for every level, best first, until fn returns false.
+func (s *BookSide) Each(fn func(level *PriceLevel) bool) {
+	for level := s.head.next[0]; level != nil; level = level.next[0] {
+		if !fn(level) {
+			return
+		}
+	}
+}
+
+// Orders returns every resting order in priority order.
+func (s *BookSide) Orders() []*OrderNode {
+	nodes := make([]*OrderNode, 0, s.orders)
+	s.Each(func(level *PriceLevel) bool {
+		for node := level.front; node != nil; node = node.next {
+			nodes = append(nodes, node)
+		}
+		return true
+	})
+	return nodes
+}
+
+// Add appends the order to the back of its price level, creating the level if needed.
+func (s *BookSide) Add(node *OrderNode) {
+	level := s.getOrCreate(node.Price)
+	node.level = level
+	level.pushBack(node)
+	level.Quantity = level.Quantity.Add(node.Quantity)
+	s.orders++
+}
+
+// Remove takes the order out of its level and drops the level once it is empty.
+func (s *BookSide) Remove(node *OrderNode) {
+	level := node.level
+	if level == nil {
+		return
+	}
+	level.remove(node)
+	level.Quantity = level.Quantity.Sub(node.Quantity)
+	node.level = nil
+	s.orders--
+	if level.count == 0 {
+		s.delete(level.Price)
+	}
+}
+
+// Reduce lowers the resting quantity of the order, keeping its place in the queue.
+func (s *BookSide) Reduce(node *OrderNode, quantity decimal.Decimal) {
+	node.Quantity = node.Quantity.Sub(quantity)
+	if node.level != nil {
+		node.level.Quantity = node.level.Quantity.Sub(quantity)
+	}
+}
+
+// before reports whether price a has priority over price b on this side.
+func (s *BookSide) before(a, b decimal.Decimal) bool {
+	if s.descending {
+		return a.GreaterThan(b)
+	}
+	return a.LessThan(b)
+}
+
+func (s *BookSide) getOrCreate(price decimal.Decimal) *PriceLevel {
+	if level, ok := s.byPrice[price]; ok {
+		return level
+	}
+
+	var update [maxSkipLevel]*PriceLevel
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && s.before(x.next[i].Price, price) {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	height := s.randomLevel()
+	if height > s.level {
+		for i := s.level; i < height; i++ {
+			update[i] = s.head
+		}
+		s.level = height
+	}
+	level := &PriceLevel{
+		Price: price,
+		next:  make([]*PriceLevel, height),
+	}
+	for i := 0; i < height; i++ {
+		level.next[i] = update[i].next[i]
+		update[i].next[i] = level
+	}
+	s.byPrice[price] = level
+	return level
+}
+
+func (s *BookSide) delete(price decimal.Decimal) {
+	if _, ok := s.byPrice[price]; !ok {
+		return
+	}
+	delete(s.byPrice, price)
+
+	var update [maxSkipLevel]*PriceLevel
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && s.before(x.next[i].Price, price) {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	level := x.next[0]
+	for i := 0; i < len(level.next); i++ {
+		update[i].next[i] = level.next[i]
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+}
+
+func (s *BookSide) randomLevel() int {
+	height := 1
+	for height < maxSkipLevel && s.random.Intn(skipLevelPercent) == 0 {
+		height++
+	}
+	return height
+}
@@ -0,0 +1,297 @@
+package matching
+
+import (
+	"container/heap"
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The benchmarks compare BookSide with the binary heap the bids were kept in before,
+// on a side of benchDepth orders spread over benchLevels price levels.
+const (
+	benchDepth  = 10000
+	benchLevels = 500
+)
+
+// heapBids is the former BidsQueue: ordered by price, then time. Cancelling an order
+// takes a linear scan, since the heap keeps no index by order.
+type heapBids []*OrderNode
+
+func (h heapBids) Len() int      { return len(h) }
+func (h heapBids) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h heapBids) Less(i, j int) bool {
+	if h[i].Price.Equal(h[j].Price) {
+		return h[i].Timestamp.Before(h[j].Timestamp)
+	}
+	return h[i].Price.GreaterThan(h[j].Price)
+}
+
+func (h *heapBids) Push(x interface{}) {
+	*h = append(*h, x.(*OrderNode))
+}
+
+func (h *heapBids) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+func (h *heapBids) cancel(orderID string) {
+	for i, node := range *h {
+		if node.OrderID == orderID {
+			heap.Remove(h, i)
+			return
+		}
+	}
+}
+
+func benchNodes() []*OrderNode {
+	r := rand.New(rand.NewSource(1))
+	start := time.Now()
+	nodes := make([]*OrderNode, benchDepth)
+	for i := range nodes {
+		nodes[i] = &OrderNode{
+			Price:     decimal.NewFromInt(int64(10000 + r.Intn(benchLevels))),
+			Quantity:  decimal.NewFromInt(1),
+			OrderID:   strconv.Itoa(i),
+			Timestamp: start.Add(time.Duration(i)),
+		}
+	}
+	return nodes
+}
+
+// fresh returns copies of the nodes, BookSide keeps its position in them.
+func fresh(nodes []*OrderNode) []*OrderNode {
+	copies := make([]*OrderNode, len(nodes))
+	for i, node := range nodes {
+		n := *node
+		copies[i] = &n
+	}
+	return copies
+}
+
+func BenchmarkInsert(b *testing.B) {
+	nodes := benchNodes()
+	b.Run("BookSide", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			batch := fresh(nodes)
+			side := NewBookSide(true)
+			b.StartTimer()
+			for _, node := range batch {
+				side.Add(node)
+			}
+		}
+	})
+	b.Run("Heap", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			batch := fresh(nodes)
+			h := make(heapBids, 0, len(batch))
+			b.StartTimer()
+			for _, node := range batch {
+				heap.Push(&h, node)
+			}
+		}
+	})
+}
+
+func BenchmarkCancel(b *testing.B) {
+	nodes := benchNodes()
+	order := rand.New(rand.NewSource(2)).Perm(len(nodes))
+	b.Run("BookSide", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			batch := fresh(nodes)
+			side := NewBookSide(true)
+			for _, node := range batch {
+				side.Add(node)
+			}
+			b.StartTimer()
+			for _, j := range order {
+				side.Remove(batch[j])
+			}
+		}
+	})
+	b.Run("Heap", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			batch := fresh(nodes)
+			h := make(heapBids, 0, len(batch))
+			for _, node := range batch {
+				heap.Push(&h, node)
+			}
+			b.StartTimer()
+			for _, j := range order {
+				h.cancel(batch[j].OrderID)
+			}
+		}
+	})
+}
+
+// BenchmarkMatch takes every order off the side in priority order, as a taker sweeping it would.
+func BenchmarkMatch(b *testing.B) {
+	nodes := benchNodes()
+	b.Run("BookSide", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			side := NewBookSide(true)
+			for _, node := range fresh(nodes) {
+				side.Add(node)
+			}
+			b.StartTimer()
+			for side.Len() > 0 {
+				side.Remove(side.Front())
+			}
+		}
+	})
+	b.Run("Heap", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			h := make(heapBids, 0, len(nodes))
+			for _, node := range fresh(nodes) {
+				heap.Push(&h, node)
+			}
+			b.StartTimer()
+			for h.Len() > 0 {
+				heap.Pop(&h)
+			}
+		}
+	})
+}
+
+func TestBookSide(t *testing.T) {
+	type add struct {
+		id    string
+		price int64
+	}
+	tests := []struct {
+		name       string
+		descending bool
+		adds       []add
+		removes    []string
+		want       []string // order ids in priority order
+		wantLevels int
+	}{
+		{
+			name:       "bids best price first",
+			descending: true,
+			adds:       []add{{"a", 100}, {"b", 102}, {"c", 99}, {"d", 101}},
+			want:       []string{"b", "d", "a", "c"},
+			wantLevels: 4,
+		},
+		{
+			name:       "asks best price first",
+			adds:       []add{{"a", 100}, {"b", 102}, {"c", 99}, {"d", 101}},
+			want:       []string{"c", "a", "d", "b"},
+			wantLevels: 4,
+		},
+		{
+			name:       "fifo within a level",
+			descending: true,
+			adds:       []add{{"a", 100}, {"b", 101}, {"c", 100}, {"d", 100}},
+			want:       []string{"b", "a", "c", "d"},
+			wantLevels: 2,
+		},
+		{
+			name:       "remove from the middle of a level",
+			adds:       []add{{"a", 100}, {"b", 100}, {"c", 100}},
+			removes:    []string{"b"},
+			want:       []string{"a", "c"},
+			wantLevels: 1,
+		},
+		{
+			name:       "remove the front and back of a level",
+			adds:       []add{{"a", 100}, {"b", 100}, {"c", 100}},
+			removes:    []string{"a", "c"},
+			want:       []string{"b"},
+			wantLevels: 1,
+		},
+		{
+			name:       "remove the last order of a level",
+			descending: true,
+			adds:       []add{{"a", 100}, {"b", 101}, {"c", 99}},
+			removes:    []string{"b"},
+			want:       []string{"a", "c"},
+			wantLevels: 2,
+		},
+		{
+			name:       "level created again after it emptied",
+			adds:       []add{{"a", 100}, {"b", 101}},
+			removes:    []string{"a", "b"},
+			want:       []string{},
+			wantLevels: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			side := NewBookSide(tt.descending)
+			nodes := make(map[string]*OrderNode)
+			for _, a := range tt.adds {
+				nodes[a.id] = &OrderNode{OrderID: a.id, Price: decimal.NewFromInt(a.price), Quantity: decimal.NewFromInt(1)}
+				side.Add(nodes[a.id])
+			}
+			for _, id := range tt.removes {
+				side.Remove(nodes[id])
+				side.Remove(nodes[id]) // removing twice is a no-op
+			}
+
+			got := make([]string, 0, side.Len())
+			for _, node := range side.Orders() {
+				got = append(got, node.OrderID)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("orders = %v, want %v", got, tt.want)
+			}
+			if side.Levels() != tt.wantLevels {
+				t.Fatalf("levels = %d, want %d", side.Levels(), tt.wantLevels)
+			}
+			levels := 0
+			side.Each(func(level *PriceLevel) bool {
+				levels++
+				if !level.Quantity.Equal(decimal.NewFromInt(int64(level.Len()))) {
+					t.Fatalf("level %s quantity = %s with %d orders", level.Price, level.Quantity, level.Len())
+				}
+				return true
+			})
+			if levels != tt.wantLevels {
+				t.Fatalf("walked %d levels, want %d", levels, tt.wantLevels)
+			}
+
+			// an emptied level is unlinked, so adding at its price starts a new queue
+			for _, id := range tt.removes {
+				side.Add(nodes[id])
+			}
+			if side.Len() != len(tt.adds) {
+				t.Fatalf("len = %d after adding back, want %d", side.Len(), len(tt.adds))
+			}
+		})
+	}
+}
+
+func TestBookSideReduce(t *testing.T) {
+	side := NewBookSide(false)
+	a := &OrderNode{OrderID: "a", Price: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(3)}
+	b := &OrderNode{OrderID: "b", Price: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(2)}
+	side.Add(a)
+	side.Add(b)
+
+	side.Reduce(a, decimal.NewFromInt(1))
+	if front := side.Front(); front != a {
+		t.Fatalf("front = %s, reduce must keep the queue position", front.OrderID)
+	}
+	if !side.Best().Quantity.Equal(decimal.NewFromInt(4)) {
+		t.Fatalf("level quantity = %s, want 4", side.Best().Quantity)
+	}
+	side.Remove(a)
+	if !side.Best().Quantity.Equal(decimal.NewFromInt(2)) || side.Front() != b {
+		t.Fatalf("level quantity = %s after removing a, want 2", side.Best().Quantity)
+	}
+}
@@ -0,0 +1,262 @@
+package matching
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/instrument"
+	"github.com/xhcdpg/crypto-trade/journal"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/types"
+	u "github.com/xhcdpg/crypto-trade/user"
+	"time"
+)
+
+func (m *MatchingEngine) CancelOrder(symbol, orderID, userID string, publisher message.Publisher) error {
+	return m.submit(symbol, &command{kind: cancelCommand, orderID: orderID, userID: userID, publisher: publisher})
+}
+
+func (m *MatchingEngine) cancelOrder(ob *OrderBook, orderID, userID string, publisher message.Publisher) error {
+	if err := m.checkCanCancel(ob); err != nil {
+		return err
+	}
+	order, err := findOrder(ob, orderID, userID)
+	if err != nil {
+		return err
+	}
+	if err := m.record(ob, &journal.Entry{Type: journal.Cancel, OrderID: orderID, UserID: userID}); err != nil {
+		return err
+	}
+	return removeAndCancel(ob, order, publisher)
+}
+
+// CancelAllOrders cancels every resting and pending stop order of the user,
+// restricted to one symbol unless symbol is empty.
+func (m *MatchingEngine) CancelAllOrders(userID, symbol string, publisher message.Publisher) error {
+	cmd := command{kind: cancelAllCommand, userID: userID, publisher: publisher}
+	if symbol != "" {
+		return m.submit(symbol, &cmd)
+	}
+	return m.broadcast(cmd)
+}
+
+func (m *MatchingEngine) cancelAllOrders(ob *OrderBook, userID string, publisher message.Publisher) error {
+	if err := m.checkCanCancel(ob); err != nil {
+		return err
+	}
+	orders := ob.userOrders(userID)
+	if len(orders) == 0 {
+		return nil
+	}
+	if err := m.record(ob, &journal.Entry{Type: journal.CancelAll, UserID: userID}); err != nil {
+		return err
+	}
+
+	for _, order := range orders {
+		if err := removeAndCancel(ob, order, publisher); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AmendOrder changes the price, stop price or total quantity of an open order; zero values are left unchanged.
+// Reducing the quantity of a resting order keeps its queue priority. Changing its price or increasing its
+// quantity loses priority: the order is taken off the book and re-entered with a new timestamp, and may
+// match immediately if the new price crosses the spread. Pending stop orders are amended in place.
+func (m *MatchingEngine) AmendOrder(symbol, orderID, userID string, price, stopPrice, quantity decimal.Decimal, publisher message.Publisher) error {
+	return m.submit(symbol, &command{
+		kind:      amendCommand,
+		orderID:   orderID,
+		userID:    userID,
+		price:     price,
+		stopPrice: stopPrice,
+		quantity:  quantity,
+		time:      time.Now(),
+		publisher: publisher,
+	})
+}
+
+func (m *MatchingEngine) amendOrder(ob *OrderBook, cmd *command, publisher message.Publisher) error {
+	orderID, price, stopPrice, quantity := cmd.orderID, cmd.price, cmd.stopPrice, cmd.quantity
+	if err := m.checkCanAmend(ob); err != nil {
+		return err
+	}
+	order, err := findOrder(ob, orderID, cmd.userID)
+	if err != nil {
+		return err
+	}
+	if !quantity.IsZero() && quantity.LessThanOrEqual(order.FilledQuantity) {
+		return errors.New("amended quantity must be greater than filled quantity")
+	}
+	if price.IsNegative() || stopPrice.IsNegative() || quantity.IsNegative() {
+		return errors.New("invalid amend parameters")
+	}
+	if closesPosition(order) && quantity.GreaterThan(order.Quantity) {
+		return errors.New("quantity of reduce-only order cannot be increased")
+	}
+	// pending stops and bracket legs waiting for their entry are not on the book
+	isStop := ob.Stops.Get(orderID) != nil || ob.pendingLeg(orderID) != nil
+	// mark prices are not journaled, the band was already checked when the amend was accepted
+	if !isStop && !price.IsZero() && !ob.replaying {
+		if err := m.checkPriceBand(ob, price); err != nil {
+			return err
+		}
+	}
+	if !isStop && !stopPrice.IsZero() {
+		return errors.New("stop price can only be amended on stop orders")
+	}
+	if order.Type == types.TrailingStop && !stopPrice.IsZero() {
+		return errors.New("stop price of trailing stop follows the market and cannot be amended")
+	}
+	// balances are not journaled either, replay trusts the checks made when the amend was accepted
+	if !ob.replaying {
+		if err := m.validateAmend(ob, order, price, stopPrice, quantity); err != nil {
+			return err
+		}
+	}
+
+	err = m.record(ob, &journal.Entry{
+		Type:      journal.Amend,
+		OrderID:   orderID,
+		UserID:    cmd.userID,
+		Price:     price,
+		StopPrice: stopPrice,
+		Quantity:  quantity,
+		Time:      cmd.time,
+	})
+	if err != nil {
+		return err
+	}
+
+	if isStop {
+		// stops are indexed by stop price, take them out while they change
+		stop := ob.Stops.Remove(orderID)
+		if !price.IsZero() {
+			order.Price = price
+		}
+		if !stopPrice.IsZero() {
+			order.StopPrice = stopPrice
+		}
+		if !quantity.IsZero() {
+			order.Quantity = quantity
+		}
+		if stop != nil {
+			ob.Stops.Add(order)
+			ob.checkStops = true
+		}
+		return publishOrder("order_amended", order, publisher)
+	}
+
+	node := ob.GetOrder(orderID)
+	if (price.IsZero() || price.Equal(order.Price)) && !quantity.IsZero() && quantity.LessThan(order.Quantity) {
+		ob.shrinkResting(node, quantity)
+		return publishOrder("order_amended", order, publisher)
+	}
+
+	ob.removeOrder(orderID)
+	if !price.IsZero() {
+		order.Price = price
+	}
+	if !quantity.IsZero() {
+		order.Quantity = quantity
+	}
+	order.Timestamp = cmd.time
+	if err := publishOrder("order_amended", order, publisher); err != nil {
+		return err
+	}
+	return m.handleLimitOrder(ob, order, publisher)
+}
+
+// validateAmend checks the order as amended against the instrument's trading rules like a new
+// order, and the margin for it when the amend raises its notional.
+func (m *MatchingEngine) validateAmend(ob *OrderBook, order *models.Order, price, stopPrice, quantity decimal.Decimal) error {
+	amended := *order
+	if !price.IsZero() {
+		amended.Price = price
+	}
+	if !stopPrice.IsZero() {
+		amended.StopPrice = stopPrice
+	}
+	if !quantity.IsZero() {
+		amended.Quantity = quantity
+	}
+
+	inst, err := m.instruments.Get(order.Symbol)
+	if err != nil {
+		return err
+	}
+	entryPrice := getEntryPrice(ob, &amended)
+	if err := instrument.ValidateOrder(inst, &amended, entryPrice); err != nil {
+		return err
+	}
+	if closesPosition(order) || entryPrice.IsZero() || amended.Quantity.Mul(entryPrice).LessThanOrEqual(order.Quantity.Mul(getEntryPrice(ob, order))) {
+		return nil
+	}
+
+	user, err := u.GlobalUserService.GetUser(order.UserID)
+	if err != nil {
+		return err
+	}
+	if user.MarginMode == types.CrossMargin {
+		return checkCrossMargin(ob, user, &amended)
+	}
+	return checkIsolatedMargin(ob, user, &amended)
+}
+
+// userOrders returns the resting orders, pending stops and waiting bracket legs of the user.
+func (ob *OrderBook) userOrders(userID string) []*models.Order {
+	var orders []*models.Order
+	for _, node := range ob.orders {
+		if node.UserID == userID {
+			orders = append(orders, node.Order)
+		}
+	}
+	for _, order := range ob.Stops.Orders() {
+		if order.UserID == userID {
+			orders = append(orders, order)
+		}
+	}
+	for _, leg := range ob.pendingLegs() {
+		if leg.UserID == userID {
+			orders = append(orders, leg)
+		}
+	}
+	return orders
+}
+
+func findOrder(ob *OrderBook, orderID, userID string) (*models.Order, error) {
+	var order *models.Order
+	if node := ob.GetOrder(orderID); node != nil {
+		order = node.Order
+	} else if stop := ob.Stops.Get(orderID); stop != nil {
+		order = stop
+	} else if leg := ob.pendingLeg(orderID); leg != nil {
+		order = leg
+	} else {
+		return nil, errors.New("order not found")
+	}
+
+	if order.UserID != userID {
+		return nil, errors.New("order does not belong to user")
+	}
+	return order, nil
+}
+
+func removeAndCancel(ob *OrderBook, order *models.Order, publisher message.Publisher) error {
+	if ob.removeOrder(order.ID) == nil && ob.Stops.Remove(order.ID) == nil {
+		ob.removePendingLeg(order.ID)
+	}
+	order.Status = types.Cancelled
+	return publishOrder("order_cancelled", order, publisher)
+}
+
+func publishOrder(topic string, order *models.Order, publisher message.Publisher) error {
+	orderJson, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	return publisher.Publish(topic, message.NewMessage(uuid.New().String(), orderJson))
+}
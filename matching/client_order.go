@@ -0,0 +1,292 @@
+package matching
+
+import (
+	"container/list"
+	"errors"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/types"
+	"sync"
+)
+
+const clientOrderHistory = 10000 // closed orders remembered per book to answer retried submissions
+
+// clientOrderIndex finds orders by user and client order id. Besides the open orders it keeps
+// the most recently closed ones, so a retried submission still finds the order it created.
+type clientOrderIndex struct {
+	orders map[string]*models.Order
+	keys   *list.List // of string, in insertion order
+	symbol string
+	owners *clientOrderOwners // nil for a book outside an engine
+}
+
+func newClientOrderIndex(symbol string) *clientOrderIndex {
+	return &clientOrderIndex{
+		orders: make(map[string]*models.Order),
+		keys:   list.New(),
+		symbol: symbol,
+	}
+}
+
+func clientOrderKey(userID, clientOrderID string) string {
+	return userID + "/" + clientOrderID
+}
+
+func (ix *clientOrderIndex) add(order *models.Order) {
+	if order.ClientOrderID == "" {
+		return
+	}
+	key := clientOrderKey(order.UserID, order.ClientOrderID)
+	existing, ok := ix.orders[key]
+	if !ok {
+		ix.keys.PushBack(key)
+	} else if existing.ID == order.ID {
+		// a triggered stop turns into an order with its id, the stop stays the original
+		return
+	}
+	ix.orders[key] = order
+	if ix.owners != nil {
+		ix.owners.bind(key, ix.symbol)
+	}
+	ix.trim()
+}
+
+func (ix *clientOrderIndex) get(userID, clientOrderID string) *models.Order {
+	return ix.orders[clientOrderKey(userID, clientOrderID)]
+}
+
+// trim forgets the oldest closed orders beyond clientOrderHistory, open orders are kept.
+func (ix *clientOrderIndex) trim() {
+	for n := ix.keys.Len(); ix.keys.Len() > clientOrderHistory && n > 0; n-- {
+		e := ix.keys.Front()
+		key := e.Value.(string)
+		if isOpen(ix.orders[key]) {
+			ix.keys.MoveToBack(e)
+			continue
+		}
+		ix.keys.Remove(e)
+		delete(ix.orders, key)
+		if ix.owners != nil {
+			ix.owners.unbind(key, ix.symbol)
+		}
+	}
+}
+
+// clientOrderOwners is shared by the books of an engine and keeps the symbol each client order id
+// of a user is used on, so the id is unique per user across symbols. An id belongs to a symbol as
+// long as its book remembers an order with it, or a submission with it is on its way to the book.
+type clientOrderOwners struct {
+	symbols map[string]string            // by clientOrderKey
+	claims  map[string]*clientOrderClaim // submissions on their way, by clientOrderKey
+	mutex   sync.Mutex
+}
+
+type clientOrderClaim struct {
+	symbol string
+	count  int
+}
+
+func newClientOrderOwners() *clientOrderOwners {
+	return &clientOrderOwners{
+		symbols: make(map[string]string),
+		claims:  make(map[string]*clientOrderClaim),
+	}
+}
+
+// claim reserves the client order id of an order for its symbol until release is called,
+// failing when the id is used on another symbol.
+func (o *clientOrderOwners) claim(order *models.Order) error {
+	if order.ClientOrderID == "" {
+		return nil
+	}
+	key := clientOrderKey(order.UserID, order.ClientOrderID)
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if symbol, ok := o.symbols[key]; ok && symbol != order.Symbol {
+		return errors.New("client order id is already used on " + symbol)
+	}
+	c, ok := o.claims[key]
+	if !ok {
+		c = &clientOrderClaim{symbol: order.Symbol}
+		o.claims[key] = c
+	} else if c.symbol != order.Symbol {
+		return errors.New("client order id is already used on " + c.symbol)
+	}
+	c.count++
+	return nil
+}
+
+func (o *clientOrderOwners) release(order *models.Order) {
+	if order.ClientOrderID == "" {
+		return
+	}
+	key := clientOrderKey(order.UserID, order.ClientOrderID)
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if c, ok := o.claims[key]; ok {
+		if c.count--; c.count == 0 {
+			delete(o.claims, key)
+		}
+	}
+}
+
+func (o *clientOrderOwners) bind(key, symbol string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.symbols[key] = symbol
+}
+
+func (o *clientOrderOwners) unbind(key, symbol string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.symbols[key] == symbol {
+		delete(o.symbols, key)
+	}
+}
+
+// claimClientOrders claims the client order ids of orders about to be submitted, the returned
+// function releases them once the submission is done.
+func (m *MatchingEngine) claimClientOrders(orders ...*models.Order) (func(), error) {
+	for i, order := range orders {
+		if err := m.clientOrders.claim(order); err != nil {
+			for _, claimed := range orders[:i] {
+				m.clientOrders.release(claimed)
+			}
+			return nil, err
+		}
+	}
+	return func() {
+		for _, order := range orders {
+			m.clientOrders.release(order)
+		}
+	}, nil
+}
+
+// closed returns copies of the remembered orders that are no longer open, oldest first.
+func (ix *clientOrderIndex) closed() []*models.Order {
+	var orders []*models.Order
+	for e := ix.keys.Front(); e != nil; e = e.Next() {
+		if order := ix.orders[e.Value.(string)]; !isOpen(order) {
+			o := *order
+			orders = append(orders, &o)
+		}
+	}
+	return orders
+}
+
+func isOpen(order *models.Order) bool {
+	return !isDone(order.Status) && order.Status != types.Triggered
+}
+
+// isClientOrderOpen is isOpen for indexed orders, where a triggered stop is open as long as
+// the order it turned into is still resting.
+func (ob *OrderBook) isClientOrderOpen(order *models.Order) bool {
+	return isOpen(order) || order.Status == types.Triggered && ob.GetOrder(order.ID) != nil
+}
+
+// findDuplicate returns the order a submission repeats: an order of the same user with the same
+// client order id, placed by an identical submission. Any other submission reuses the client order
+// id, which is an error while the order is open, including when it was amended since.
+func (ob *OrderBook) findDuplicate(order *models.Order) (*models.Order, error) {
+	if order.ClientOrderID == "" {
+		return nil, nil
+	}
+	original := ob.clientOrders.get(order.UserID, order.ClientOrderID)
+	if original == nil {
+		return nil, nil
+	}
+	if sameSubmission(original, order) {
+		return original, nil
+	}
+	if ob.isClientOrderOpen(original) {
+		return nil, errors.New("client order id is already used by an open order")
+	}
+	return nil, nil
+}
+
+// sameSubmission compares every field a submission sets, with the defaults applied on acceptance.
+// The price of market orders is set from the slippage limit, the stop price of trailing stops
+// follows the market and the quantity of closing orders follows the position, so these are not compared.
+func sameSubmission(original, order *models.Order) bool {
+	timeInForce := order.TimeInForce
+	if timeInForce == "" {
+		timeInForce = types.GTC
+	}
+	workingType := order.WorkingType
+	if workingType == "" {
+		workingType = types.LastPrice
+	}
+	positionSide := order.PositionSide
+	if positionSide == "" {
+		positionSide = types.Both
+	}
+	if original.Side != order.Side || original.Type != order.Type || original.TimeInForce != timeInForce ||
+		order.Type != types.TrailingStop && !original.StopPrice.Equal(order.StopPrice) ||
+		original.ReduceOnly != order.ReduceOnly || original.ClosePosition != order.ClosePosition {
+		return false
+	}
+	if original.Leverage != order.Leverage || original.MarginType != order.MarginType || original.PositionSide != positionSide ||
+		!original.DisplayQuantity.Equal(order.DisplayQuantity) || !original.ExpireTime.Equal(order.ExpireTime) ||
+		original.WorkingType != workingType || !original.CallbackRate.Equal(order.CallbackRate) ||
+		!original.TrailingDelta.Equal(order.TrailingDelta) || !original.ActivationPrice.Equal(order.ActivationPrice) ||
+		original.STPMode != order.STPMode || original.STPGroupID != order.STPGroupID {
+		return false
+	}
+	if order.Type != types.Market && order.Type != types.MarketStopLoss && order.Type != types.MarketTakeProfit &&
+		!original.Price.Equal(order.Price) {
+		return false
+	}
+	return closesPosition(original) || original.Quantity.Equal(order.Quantity)
+}
+
+// CancelOrderByClientID cancels the open order the user placed with the given client order id.
+func (m *MatchingEngine) CancelOrderByClientID(symbol, clientOrderID, userID string, publisher message.Publisher) error {
+	return m.submit(symbol, &command{kind: cancelCommand, clientOrderID: clientOrderID, userID: userID, publisher: publisher})
+}
+
+func (m *MatchingEngine) cancelClientOrder(ob *OrderBook, clientOrderID, userID string, publisher message.Publisher) error {
+	order := ob.clientOrders.get(userID, clientOrderID)
+	if order == nil || !ob.isClientOrderOpen(order) {
+		return errors.New("order not found")
+	}
+	// a triggered stop is cancelled through the order it turned into, which has its id
+	return m.cancelOrder(ob, order.ID, userID, publisher)
+}
+
+// GetOrder returns a copy of an open order of the user.
+func (m *MatchingEngine) GetOrder(symbol, orderID, userID string) (*models.Order, error) {
+	var (
+		order *models.Order
+		err   error
+	)
+	submitErr := m.submit(symbol, &command{kind: queryCommand, query: func(ob *OrderBook) {
+		var found *models.Order
+		if found, err = findOrder(ob, orderID, userID); err == nil {
+			o := *found
+			order = &o
+		}
+	}})
+	if submitErr != nil {
+		return nil, submitErr
+	}
+	return order, err
+}
+
+// GetOrderByClientID returns a copy of the order the user placed with the given client order id,
+// open or recently closed.
+func (m *MatchingEngine) GetOrderByClientID(symbol, clientOrderID, userID string) (*models.Order, error) {
+	var order *models.Order
+	err := m.submit(symbol, &command{kind: queryCommand, query: func(ob *OrderBook) {
+		if found := ob.clientOrders.get(userID, clientOrderID); found != nil {
+			o := *found
+			order = &o
+		}
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if order == nil {
+		return nil, errors.New("order not found")
+	}
+	return order, nil
+}
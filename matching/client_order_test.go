@@ -0,0 +1,75 @@
+package matching
+
+import (
+	"github.com/xhcdpg/crypto-trade/types"
+	"testing"
+)
+
+func TestRetriedClientOrder(t *testing.T) {
+	engine := newTestEngine(t)
+	original := newTestOrder("alice", types.Buy, types.Limit, "90", "1")
+	original.ClientOrderID = "client-1"
+	engine.place(t, original)
+
+	retry := *original
+	retry.ID = "retry"
+	retry.Status = ""
+	retry.Timestamp = original.Timestamp.Add(1)
+	engine.place(t, &retry)
+	if retry.ID != original.ID {
+		t.Fatalf("retry placed order %s, want the original %s", retry.ID, original.ID)
+	}
+
+	changed := retry
+	changed.ID = "changed"
+	changed.Quantity = original.Quantity.Add(original.Quantity)
+	if err := engine.PlaceOrder(&changed, engine.publisher); err == nil {
+		t.Fatal("order reusing the client order id of an open order with another quantity was accepted")
+	}
+	if got := engine.publisher.count("orders"); got != 1 {
+		t.Fatalf("%d orders accepted, want 1", got)
+	}
+}
+
+func TestRetryAfterSnapshot(t *testing.T) {
+	engine := newTestEngine(t)
+	engine.place(t, newTestOrder("maker", types.Sell, types.Limit, "100", "1"))
+	original := newTestOrder("alice", types.Buy, types.Limit, "100", "1")
+	original.ClientOrderID = "client-1"
+	engine.place(t, original)
+	if original.Status != types.Filled {
+		t.Fatalf("original = %s, want %s", original.Status, types.Filled)
+	}
+	if err := engine.TakeSnapshots(); err != nil {
+		t.Fatal(err)
+	}
+	engine.restart(t)
+
+	retry := newTestOrder("alice", types.Buy, types.Limit, "100", "1")
+	retry.ClientOrderID = "client-1"
+	engine.place(t, retry)
+	if retry.ID != original.ID || retry.Status != types.Filled {
+		t.Fatalf("retry = %s %s, want the filled original %s", retry.ID, retry.Status, original.ID)
+	}
+	if got := engine.publisher.count("orders"); got != 2 {
+		t.Fatalf("%d orders accepted, want 2", got)
+	}
+}
+
+func TestClientOrderIDUniqueAcrossSymbols(t *testing.T) {
+	engine := newTestEngine(t)
+	first := newTestOrder("alice", types.Buy, types.Limit, "90", "1")
+	first.ClientOrderID = "client-1"
+	engine.place(t, first)
+
+	other := newTestOrder("alice", types.Buy, types.Limit, "90", "1")
+	other.Symbol = otherSymbol
+	other.ClientOrderID = "client-1"
+	if err := engine.PlaceOrder(other, engine.publisher); err == nil {
+		t.Fatal("client order id used on another symbol was accepted")
+	}
+
+	// the restriction is per user
+	other.UserID = "bob"
+	engine.place(t, other)
+}
@@ -0,0 +1,125 @@
+package matching
+
+import (
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/models"
+)
+
+const tickerImbalanceLevels = 5
+
+func (m *MatchingEngine) GetDepth(symbol string, levels int) (*models.Depth, error) {
+	var depth *models.Depth
+	err := m.submit(symbol, &command{kind: queryCommand, query: func(ob *OrderBook) {
+		depth = ob.Depth(levels)
+	}})
+	return depth, err
+}
+
+func (m *MatchingEngine) GetOrderDepth(symbol string, levels int) (*models.OrderDepth, error) {
+	var depth *models.OrderDepth
+	err := m.submit(symbol, &command{kind: queryCommand, query: func(ob *OrderBook) {
+		depth = ob.OrderDepth(levels)
+	}})
+	return depth, err
+}
+
+func (m *MatchingEngine) GetBookTicker(symbol string) (*models.BookTicker, error) {
+	var ticker *models.BookTicker
+	err := m.submit(symbol, &command{kind: queryCommand, query: func(ob *OrderBook) {
+		ticker = ob.Ticker()
+	}})
+	return ticker, err
+}
+
+// Depth aggregates the book into L2 price levels, best first. levels <= 0 returns every level.
+func (ob *OrderBook) Depth(levels int) *models.Depth {
+	return &models.Depth{
+		Symbol:   ob.Symbol,
+		Sequence: ob.Sequence,
+		Bids:     aggregateLevels(ob.Bids, levels),
+		Asks:     aggregateLevels(ob.Asks, levels),
+	}
+}
+
+// OrderDepth lists the individual resting orders (L3) of each price level, in queue order.
+func (ob *OrderBook) OrderDepth(levels int) *models.OrderDepth {
+	return &models.OrderDepth{
+		Symbol:   ob.Symbol,
+		Sequence: ob.Sequence,
+		Bids:     orderLevels(ob.Bids, levels),
+		Asks:     orderLevels(ob.Asks, levels),
+	}
+}
+
+func (ob *OrderBook) Ticker() *models.BookTicker {
+	depth := ob.Depth(1)
+	ticker := &models.BookTicker{
+		Symbol:    ob.Symbol,
+		Sequence:  ob.Sequence,
+		Spread:    ob.Spread(),
+		Imbalance: ob.Imbalance(tickerImbalanceLevels),
+	}
+	if len(depth.Bids) > 0 {
+		ticker.BestBid = depth.Bids[0].Price
+		ticker.BestBidQuantity = depth.Bids[0].Quantity
+	}
+	if len(depth.Asks) > 0 {
+		ticker.BestAsk = depth.Asks[0].Price
+		ticker.BestAskQuantity = depth.Asks[0].Quantity
+	}
+	return ticker
+}
+
+// Spread is the best ask minus the best bid, or zero when either side is empty.
+func (ob *OrderBook) Spread() decimal.Decimal {
+	if ob.Asks.Len() == 0 || ob.Bids.Len() == 0 {
+		return decimal.Zero
+	}
+	return ob.Asks.BestPrice().Sub(ob.Bids.BestPrice())
+}
+
+// Imbalance compares the bid and ask quantity of the top levels, from -1 (only asks) to 1 (only bids).
+func (ob *OrderBook) Imbalance(levels int) decimal.Decimal {
+	depth := ob.Depth(levels)
+	bidQuantity, askQuantity := decimal.Zero, decimal.Zero
+	for _, level := range depth.Bids {
+		bidQuantity = bidQuantity.Add(level.Quantity)
+	}
+	for _, level := range depth.Asks {
+		askQuantity = askQuantity.Add(level.Quantity)
+	}
+
+	total := bidQuantity.Add(askQuantity)
+	if total.IsZero() {
+		return decimal.Zero
+	}
+	return bidQuantity.Sub(askQuantity).Div(total)
+}
+
+func aggregateLevels(side *BookSide, levels int) []models.PriceLevel {
+	result := []models.PriceLevel{}
+	side.Each(func(level *PriceLevel) bool {
+		if levels > 0 && len(result) == levels {
+			return false
+		}
+		result = append(result, models.PriceLevel{Price: level.Price, Quantity: level.Quantity, Orders: level.Len()})
+		return true
+	})
+	return result
+}
+
+func orderLevels(side *BookSide, levels int) []models.OrderLevel {
+	result := []models.OrderLevel{}
+	side.Each(func(level *PriceLevel) bool {
+		if levels > 0 && len(result) == levels {
+			return false
+		}
+		orders := make([]models.BookOrder, 0, level.Len())
+		for _, node := range level.Orders() {
+			orders = append(orders, models.BookOrder{OrderID: node.OrderID, Quantity: node.Quantity, Timestamp: node.Timestamp})
+		}
+		result = append(result, models.OrderLevel{Price: level.Price, Orders: orders})
+		return true
+	})
+	return result
+}
@@ -0,0 +1,67 @@
+package matching
+
+import (
+	"context"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/xhcdpg/crypto-trade/journal"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/types"
+	"log"
+	"time"
+)
+
+// RunExpirySweeper expires good-till-date orders every interval until ctx is done.
+func (m *MatchingEngine) RunExpirySweeper(ctx context.Context, interval time.Duration, publisher message.Publisher) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := m.ExpireOrders(now, publisher); err != nil {
+				log.Println("failed to expire orders", err)
+			}
+		}
+	}
+}
+
+// ExpireOrders removes every resting or pending good-till-date order whose expire time is not after now.
+func (m *MatchingEngine) ExpireOrders(now time.Time, publisher message.Publisher) error {
+	return m.broadcast(command{kind: expireCommand, time: now, publisher: publisher})
+}
+
+func (m *MatchingEngine) expireOrders(ob *OrderBook, now time.Time, publisher message.Publisher) error {
+	var expired []*models.Order
+	for _, node := range ob.orders {
+		if isExpired(node.Order, now) {
+			expired = append(expired, node.Order)
+		}
+	}
+	for _, order := range ob.Stops.Orders() {
+		if isExpired(order, now) {
+			expired = append(expired, order)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	if err := m.record(ob, &journal.Entry{Type: journal.Expire, Time: now}); err != nil {
+		return err
+	}
+
+	for _, order := range expired {
+		if ob.removeOrder(order.ID) == nil {
+			ob.Stops.Remove(order.ID)
+		}
+		order.Status = types.Expired
+		if err := publishOrder("order_expired", order, publisher); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isExpired(order *models.Order, now time.Time) bool {
+	return order.TimeInForce == types.GTD && !order.ExpireTime.After(now)
+}
@@ -0,0 +1,455 @@
+package matching
+
+import (
+	"errors"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/instrument"
+	"github.com/xhcdpg/crypto-trade/journal"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/types"
+	u "github.com/xhcdpg/crypto-trade/user"
+	"log"
+	"time"
+)
+
+// bracket is an entry order whose take-profit and stop-loss legs wait for it to be done.
+type bracket struct {
+	entry *models.Order
+	legs  []*models.Order
+}
+
+// ocoGroup is a set of live orders where the first one to fill or trigger cancels the others.
+type ocoGroup struct {
+	id     string
+	orders []*models.Order
+}
+
+// PlaceOCO places orders of the same user and symbol that cancel each other: as soon as
+// one of them fills, triggers or is cancelled, the others are cancelled.
+func (m *MatchingEngine) PlaceOCO(orders []*models.Order, publisher message.Publisher) error {
+	if len(orders) < 2 {
+		return errors.New("oco group needs at least two orders")
+	}
+	groupID := uuid.New().String()
+	for _, order := range orders {
+		order.OCOGroupID = groupID
+		order.ParentID = ""
+	}
+	return m.placeGroup(orders, publisher)
+}
+
+// PlaceBracket places an entry order with take-profit and stop-loss legs. The legs wait
+// until the entry is filled, or cancelled after a partial fill, and are then activated
+// for the filled quantity as an OCO pair. They are cancelled if the entry never fills.
+// Either leg may be nil.
+func (m *MatchingEngine) PlaceBracket(entry, takeProfit, stopLoss *models.Order, publisher message.Publisher) error {
+	orders := []*models.Order{entry}
+	for _, leg := range []*models.Order{takeProfit, stopLoss} {
+		if leg == nil {
+			continue
+		}
+		leg.ParentID = entry.ID
+		leg.OCOGroupID = entry.ID
+		if leg.PositionSide == "" {
+			leg.PositionSide = entry.PositionSide
+		}
+		// legs close what the entry opens; in hedge mode the position side already says so
+		if leg.PositionSide == "" || leg.PositionSide == types.Both {
+			leg.ReduceOnly = true
+		}
+		if leg.Quantity.IsZero() {
+			leg.Quantity = entry.Quantity
+		}
+		orders = append(orders, leg)
+	}
+	if len(orders) == 1 {
+		return errors.New("bracket order needs a take-profit or stop-loss leg")
+	}
+	entry.ParentID = ""
+	entry.OCOGroupID = ""
+	return m.placeGroup(orders, publisher)
+}
+
+func (m *MatchingEngine) placeGroup(orders []*models.Order, publisher message.Publisher) error {
+	lock := m.positionModes.get(orders[0].UserID)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	user, err := u.GlobalUserService.GetUser(orders[0].UserID)
+	if err != nil {
+		return err
+	}
+	release, err := m.claimClientOrders(orders...)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	now := time.Now()
+	placed := make([]*models.Order, len(orders))
+	for i, order := range orders {
+		o := *order
+		if o.Timestamp.IsZero() {
+			o.Timestamp = now
+		}
+		placed[i] = &o
+	}
+	return m.submit(orders[0].Symbol, &command{kind: placeGroupCommand, orders: placed, callerOrders: orders, user: user, publisher: publisher})
+}
+
+func (m *MatchingEngine) placeOrderGroup(ob *OrderBook, orders []*models.Order, user *models.User, publisher message.Publisher) error {
+	if err := validateGroup(orders); err != nil {
+		return err
+	}
+	// a retried group is recognized by its first order, the others must not reuse open client order ids
+	for i, order := range orders {
+		original, err := ob.findDuplicate(order)
+		if err != nil {
+			return err
+		}
+		if i == 0 && original != nil {
+			return ob.copyGroup(orders)
+		}
+		if original != nil && isOpen(original) {
+			return errors.New("client order id is already used by an open order")
+		}
+	}
+	for _, order := range orders {
+		var err error
+		if order.ParentID != "" {
+			err = m.validateLeg(ob, order, user)
+		} else {
+			err = m.validateOrder(ob, order, user)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := m.startListingAuction(ob); err != nil {
+		return err
+	}
+	if err := m.record(ob, &journal.Entry{Type: journal.PlaceGroup, Orders: orders}); err != nil {
+		return err
+	}
+	return m.applyGroup(ob, orders, publisher)
+}
+
+// copyGroup overwrites the orders of a retried group with the current state of the originals.
+func (ob *OrderBook) copyGroup(orders []*models.Order) error {
+	for _, order := range orders {
+		if order.ClientOrderID == "" {
+			continue
+		}
+		if original := ob.clientOrders.get(order.UserID, order.ClientOrderID); original != nil {
+			*order = *original
+		}
+	}
+	return nil
+}
+
+func validateGroup(orders []*models.Order) error {
+	first := orders[0]
+	ids := make(map[string]bool, len(orders))
+	for _, order := range orders {
+		if order.Symbol != first.Symbol || order.UserID != first.UserID {
+			return errors.New("orders of a group must have the same symbol and user")
+		}
+		if ids[order.ID] {
+			return errors.New("orders of a group must have different ids")
+		}
+		ids[order.ID] = true
+	}
+
+	if orders[1].ParentID == "" {
+		for _, order := range orders {
+			if order.Type == types.Market {
+				return errors.New("market orders cannot be part of an oco group")
+			}
+		}
+		return nil
+	}
+
+	if first.Type != types.Limit && first.Type != types.Market {
+		return errors.New("bracket entry must be a limit or market order")
+	}
+	for _, leg := range orders[1:] {
+		if leg.Side == first.Side {
+			return errors.New("bracket legs must be on the opposite side of the entry")
+		}
+		if leg.PositionSide != first.PositionSide {
+			return errors.New("bracket legs must be on the position side of the entry")
+		}
+		if leg.Type == types.Market {
+			return errors.New("bracket legs cannot be market orders")
+		}
+	}
+	return nil
+}
+
+// validateLeg checks a bracket leg without margin and reduce-only checks: it closes the
+// position its entry opens, which does not exist yet. Stop legs are fully validated
+// again when they trigger.
+func (m *MatchingEngine) validateLeg(ob *OrderBook, leg *models.Order, user *models.User) error {
+	inst, err := m.instruments.Get(leg.Symbol)
+	if err != nil {
+		return err
+	}
+	if err := ob.checkOrderID(leg.ID); err != nil {
+		return err
+	}
+	if err := validatePositionSide(user, leg); err != nil {
+		return err
+	}
+	if err := instrument.ValidateOrder(inst, leg, getEntryPrice(ob, leg)); err != nil {
+		return err
+	}
+	if err := validateSelfTradePrevention(leg); err != nil {
+		return err
+	}
+	if err := validateWorkingType(leg); err != nil {
+		return err
+	}
+	return validateTimeInForce(leg)
+}
+
+func (m *MatchingEngine) applyGroup(ob *OrderBook, orders []*models.Order, publisher message.Publisher) error {
+	if orders[1].ParentID != "" {
+		for _, leg := range orders[1:] {
+			leg.Status = types.Pending
+			ob.clientOrders.add(leg)
+		}
+		ob.brackets = append(ob.brackets, &bracket{entry: orders[0], legs: orders[1:]})
+		return m.applyOrder(ob, orders[0], publisher)
+	}
+	return m.applyOCO(ob, &ocoGroup{id: orders[0].OCOGroupID, orders: orders}, publisher)
+}
+
+// applyOCO enters the orders of a group one by one, stopping as soon as one of them
+// already completes the group; resolveGroups cancels the rest.
+func (m *MatchingEngine) applyOCO(ob *OrderBook, group *ocoGroup, publisher message.Publisher) error {
+	ob.ocoGroups = append(ob.ocoGroups, group)
+	for _, order := range group.orders {
+		if err := m.applyOrder(ob, order, publisher); err != nil {
+			return err
+		}
+		if group.done() != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// resolveGroups runs after every command: it activates or cancels the legs of bracket entries
+// that are done and cancels the remaining orders of OCO groups that have been hit. It only
+// depends on the state of the book, so replay reaches the same result without journaling it.
+func (m *MatchingEngine) resolveGroups(ob *OrderBook, publisher message.Publisher) error {
+	var ready []*bracket
+	waiting := ob.brackets[:0]
+	for _, b := range ob.brackets {
+		if isDone(b.entry.Status) {
+			ready = append(ready, b)
+		} else {
+			waiting = append(waiting, b)
+		}
+	}
+	ob.brackets = waiting
+
+	for _, b := range ready {
+		if err := m.activateLegs(ob, b, publisher); err != nil {
+			return err
+		}
+	}
+
+	var hit []*ocoGroup
+	live := ob.ocoGroups[:0]
+	for _, group := range ob.ocoGroups {
+		if group.done() != nil {
+			hit = append(hit, group)
+		} else {
+			live = append(live, group)
+		}
+	}
+	ob.ocoGroups = live
+
+	for _, group := range hit {
+		winner := group.done()
+		for _, order := range group.orders {
+			if order == winner || isDone(order.Status) || order.Status == types.Triggered {
+				continue
+			}
+			if err := removeAndCancel(ob, order, publisher); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// activateLegs enters the legs of a done bracket as an OCO group for at most the filled quantity
+// of the entry. Each leg is validated against the position the entry opened and refused on its
+// own, so a refused take-profit leaves the stop-loss in place. Validation depends on positions,
+// so its outcome is journaled and replay activates the legs the way the entries recorded.
+func (m *MatchingEngine) activateLegs(ob *OrderBook, b *bracket, publisher message.Publisher) error {
+	if b.entry.FilledQuantity.IsZero() {
+		for _, leg := range b.legs {
+			leg.Status = types.Cancelled
+			if err := publishOrder("order_cancelled", leg, publisher); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var legs []*models.Order
+	for _, leg := range b.legs {
+		leg.Quantity = decimal.Min(leg.Quantity, b.entry.FilledQuantity)
+		if err := m.acceptLeg(ob, leg); err != nil {
+			log.Println("bracket leg refused", leg.ID, err)
+			if err := rejectOrder(leg, nil, publisher); err != nil {
+				return err
+			}
+			continue
+		}
+		legs = append(legs, leg)
+	}
+	if len(legs) == 0 {
+		return nil
+	}
+
+	group := &ocoGroup{id: b.entry.ID, orders: legs}
+	ob.ocoGroups = append(ob.ocoGroups, group)
+	for _, leg := range legs {
+		if err := m.applyOrder(ob, leg, publisher); err != nil {
+			// refused by the book, e.g. a post-only take-profit that would cross: the other leg stays
+			log.Println("bracket leg refused", leg.ID, err)
+			group.remove(leg)
+			continue
+		}
+		if group.done() != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// acceptLeg validates a leg about to be activated and journals the quantity it is activated for.
+// Replay takes the outcome from the journal instead.
+func (m *MatchingEngine) acceptLeg(ob *OrderBook, leg *models.Order) error {
+	if ob.replaying {
+		quantity, ok := ob.replayActivations[leg.ID]
+		if !ok {
+			// journaled before activations were
+			return nil
+		}
+		if quantity.IsZero() {
+			return errors.New("refused when it was activated")
+		}
+		leg.Quantity = quantity
+		return nil
+	}
+
+	user, err := u.GlobalUserService.GetUser(leg.UserID)
+	if err == nil {
+		err = m.validateOrder(ob, leg, user)
+	}
+	quantity := leg.Quantity
+	if err != nil {
+		quantity = decimal.Zero
+	}
+	if recordErr := m.record(ob, &journal.Entry{Type: journal.Activate, OrderID: leg.ID, Quantity: quantity}); recordErr != nil {
+		return recordErr
+	}
+	return err
+}
+
+func (g *ocoGroup) remove(order *models.Order) {
+	for i, o := range g.orders {
+		if o == order {
+			g.orders = append(g.orders[:i], g.orders[i+1:]...)
+			return
+		}
+	}
+}
+
+// done returns the order that completed the group: the first one that was filled,
+// even partially, triggered, cancelled or expired.
+func (g *ocoGroup) done() *models.Order {
+	for _, order := range g.orders {
+		if order.Status == types.PartiallyFilled || order.Status == types.Triggered || isDone(order.Status) {
+			return order
+		}
+	}
+	return nil
+}
+
+func isDone(status types.OrderStatus) bool {
+	return status == types.Filled || status == types.Cancelled || status == types.Expired
+}
+
+// pendingLeg returns a bracket leg that is still waiting for its entry.
+func (ob *OrderBook) pendingLeg(orderID string) *models.Order {
+	for _, b := range ob.brackets {
+		for _, leg := range b.legs {
+			if leg.ID == orderID {
+				return leg
+			}
+		}
+	}
+	return nil
+}
+
+func (ob *OrderBook) removePendingLeg(orderID string) *models.Order {
+	for _, b := range ob.brackets {
+		for i, leg := range b.legs {
+			if leg.ID == orderID {
+				b.legs = append(b.legs[:i], b.legs[i+1:]...)
+				return leg
+			}
+		}
+	}
+	return nil
+}
+
+// pendingLegs lists the waiting bracket legs in bracket order.
+func (ob *OrderBook) pendingLegs() []*models.Order {
+	var legs []*models.Order
+	for _, b := range ob.brackets {
+		legs = append(legs, b.legs...)
+	}
+	return legs
+}
+
+// restoreGroups rebuilds the brackets and OCO groups of a book restored from a snapshot.
+func (ob *OrderBook) restoreGroups(orders []*models.Order, legs []*models.Order) {
+	groups := make(map[string]*ocoGroup)
+	for _, order := range orders {
+		if order.OCOGroupID == "" {
+			continue
+		}
+		group, ok := groups[order.OCOGroupID]
+		if !ok {
+			group = &ocoGroup{id: order.OCOGroupID}
+			groups[order.OCOGroupID] = group
+			ob.ocoGroups = append(ob.ocoGroups, group)
+		}
+		group.orders = append(group.orders, order)
+	}
+
+	for _, leg := range legs {
+		if n := len(ob.brackets); n > 0 && ob.brackets[n-1].entry.ID == leg.ParentID {
+			ob.brackets[n-1].legs = append(ob.brackets[n-1].legs, leg)
+			continue
+		}
+		var entry *models.Order
+		if node := ob.GetOrder(leg.ParentID); node != nil {
+			entry = node.Order
+		}
+		if entry == nil {
+			continue
+		}
+		ob.brackets = append(ob.brackets, &bracket{entry: entry, legs: []*models.Order{leg}})
+	}
+}
@@ -0,0 +1,43 @@
+package matching
+
+import (
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/types"
+	"testing"
+)
+
+func TestRefusedLegKeepsOtherLeg(t *testing.T) {
+	engine := newTestEngine(t)
+	engine.place(t, newTestOrder("bid", types.Buy, types.Limit, "99", "1"))
+	engine.place(t, newTestOrder("maker", types.Sell, types.Limit, "100", "1"))
+
+	entry := newTestOrder("alice", types.Buy, types.Limit, "100", "1")
+	// crosses the bid at 99 once active, so the book refuses it
+	takeProfit := newTestOrder("alice", types.Sell, types.Limit, "99", "1")
+	takeProfit.TimeInForce = types.PostOnly
+	stopLoss := newTestOrder("alice", types.Sell, types.MarketStopLoss, "", "0.5")
+	stopLoss.StopPrice = decimal.NewFromInt(90)
+	if err := engine.PlaceBracket(entry, takeProfit, stopLoss, engine.publisher); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != types.Filled {
+		t.Fatalf("entry = %s, want %s", entry.Status, types.Filled)
+	}
+
+	check := func() {
+		t.Helper()
+		if _, err := engine.GetOrder(testSymbol, takeProfit.ID, "alice"); err == nil {
+			t.Fatal("refused take-profit is open")
+		}
+		stop, err := engine.GetOrder(testSymbol, stopLoss.ID, "alice")
+		if err != nil {
+			t.Fatalf("stop-loss is not open: %v", err)
+		}
+		if stop.Status != types.Pending || !stop.ReduceOnly || stop.Quantity.String() != "0.5" {
+			t.Fatalf("stop-loss = %s reduce-only %v for %s, want a pending reduce-only stop for 0.5", stop.Status, stop.ReduceOnly, stop.Quantity)
+		}
+	}
+	check()
+	engine.restart(t)
+	check()
+}
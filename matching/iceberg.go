@@ -0,0 +1,55 @@
+package matching
+
+import (
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/models"
+)
+
+// visibleQuantity is the part of the remaining quantity an order shows on the book:
+// one display slice for iceberg orders, everything for the others.
+func visibleQuantity(order *models.Order) decimal.Decimal {
+	remaining := remainingQuantity(order)
+	if order.DisplayQuantity.IsPositive() {
+		return decimal.Min(order.DisplayQuantity, remaining)
+	}
+	return remaining
+}
+
+// replenish shows the next slice of an iceberg order whose visible part was consumed.
+// The new slice joins the back of its price level, losing time priority. It reports
+// false when there is no hidden reserve left.
+func (ob *OrderBook) replenish(node *OrderNode) bool {
+	quantity := visibleQuantity(node.Order)
+	if !quantity.IsPositive() {
+		return false
+	}
+	side := ob.side(node.Order.Side)
+	side.Remove(node)
+	node.Quantity = quantity
+	side.Add(node)
+	return true
+}
+
+// shrinkResting lowers the total quantity of a resting order, keeping its queue priority.
+// The visible part of an iceberg only shrinks once its hidden reserve is used up.
+func (ob *OrderBook) shrinkResting(node *OrderNode, quantity decimal.Decimal) {
+	visible := decimal.Min(node.Quantity, quantity.Sub(node.Order.FilledQuantity))
+	ob.side(node.Order.Side).Reduce(node, node.Quantity.Sub(visible))
+	node.Order.Quantity = quantity
+}
+
+// icebergVisible returns the visible quantity of every resting iceberg order for snapshots,
+// since a partly consumed slice cannot be derived from the order alone.
+func (ob *OrderBook) icebergVisible() map[string]decimal.Decimal {
+	var visible map[string]decimal.Decimal
+	for orderID, node := range ob.orders {
+		if !node.Order.DisplayQuantity.IsPositive() {
+			continue
+		}
+		if visible == nil {
+			visible = make(map[string]decimal.Decimal)
+		}
+		visible[orderID] = node.Quantity
+	}
+	return visible
+}
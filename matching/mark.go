@@ -0,0 +1,74 @@
+package matching
+
+import (
+	"context"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/types"
+	"log"
+	"sort"
+	"time"
+)
+
+// markBasisWeight is the weight of the latest mid-index spread in the basis of the mark price,
+// older spreads decay by 1-markBasisWeight every tick.
+var markBasisWeight = decimal.New(1, -1)
+
+// RunMarkPrices recomputes the mark price of every book each interval until ctx is done.
+// Stops working on the mark price are checked and the open positions of the symbol are
+// revalued at the new mark. Use either this loop or an external feed through UpdateMarkPrice.
+func (m *MatchingEngine) RunMarkPrices(ctx context.Context, interval time.Duration, publisher message.Publisher) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.broadcast(command{kind: markCommand, publisher: publisher}); err != nil {
+				log.Println("failed to update mark prices", err)
+			}
+		}
+	}
+}
+
+func (m *MatchingEngine) tickMarkPrice(ob *OrderBook) error {
+	mark := ob.markPrice()
+	if !mark.IsPositive() {
+		return nil
+	}
+	ob.setPrice(types.MarkPrice, mark)
+	return m.positionManager.Revalue(ob.Symbol, mark)
+}
+
+// markPrice is the median of the index price plus a decaying basis, the mid price and the
+// last price, leaving out those that are not known yet.
+func (ob *OrderBook) markPrice() decimal.Decimal {
+	mid := ob.GetMidPrice()
+	var prices []decimal.Decimal
+	if ob.IndexPrice.IsPositive() {
+		if mid.IsPositive() {
+			ob.markBasis = ob.markBasis.Add(mid.Sub(ob.IndexPrice).Sub(ob.markBasis).Mul(markBasisWeight))
+		}
+		prices = append(prices, ob.IndexPrice.Add(ob.markBasis))
+	}
+	if mid.IsPositive() {
+		prices = append(prices, mid)
+	}
+	if ob.LastPrice.IsPositive() {
+		prices = append(prices, ob.LastPrice)
+	}
+	return median(prices)
+}
+
+func median(prices []decimal.Decimal) decimal.Decimal {
+	if len(prices) == 0 {
+		return decimal.Zero
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i].LessThan(prices[j]) })
+	n := len(prices)
+	if n%2 == 1 {
+		return prices[n/2]
+	}
+	return prices[n/2-1].Add(prices[n/2]).Div(decimal.NewFromInt(2))
+}
@@ -1,410 +1,715 @@
 package matching
 
 import (
-	"container/heap"
 	"encoding/json"
 	"errors"
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/google/uuid"
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/instrument"
+	"github.com/xhcdpg/crypto-trade/journal"
 	"github.com/xhcdpg/crypto-trade/models"
 	"github.com/xhcdpg/crypto-trade/position"
+	"github.com/xhcdpg/crypto-trade/snapshot"
 	"github.com/xhcdpg/crypto-trade/types"
 	u "github.com/xhcdpg/crypto-trade/user"
+	"log"
+	"sync"
 	"time"
 )
 
 type OrderNode struct {
-	Price     float64
-	Quantity  float64
+	Price     decimal.Decimal
+	Quantity  decimal.Decimal
 	OrderID   string
 	UserID    string
 	Timestamp time.Time
+	Order     *models.Order
+	level     *PriceLevel // level the order rests on
+	prev      *OrderNode  // neighbours in the level's queue, for O(1) removal
+	next      *OrderNode
 }
 
-type BidsQueue []*OrderNode
+type OrderBook struct {
+	Symbol            string
+	Bids              *BookSide
+	Asks              *BookSide
+	Stops             *StopQueue
+	Sequence          uint64                // sequence number of the last accepted command
+	messages          map[string]uint64     // messages published so far, by topic
+	LastPrice         decimal.Decimal       // 最新成交价
+	MarkPrice         decimal.Decimal       // 标记价格, set by UpdateMarkPrice
+	IndexPrice        decimal.Decimal       // 指数价格, set by UpdateIndexPrice
+	markBasis         decimal.Decimal       // decaying average of mid price minus index price
+	orders            map[string]*OrderNode // resting orders by order id
+	clientOrders      *clientOrderIndex
+	brackets          []*bracket
+	ocoGroups         []*ocoGroup
+	checkStops        bool // a price moved or a stop was added since stops were last checked
+	replaying         bool
+	replayClips       map[string]decimal.Decimal // clips recorded by the command being replayed, by clipKey
+	replayActivations map[string]decimal.Decimal // bracket legs activated by the command being replayed, by order id
+	breaker           circuitBreaker
+	auction           bool                 // 集合竞价中: limit orders rest without matching until the uncross
+	indicative        *models.AuctionPrice // last indicative price published
+}
 
-func (b BidsQueue) Len() int      { return len(b) }
-func (b BidsQueue) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
-func (b BidsQueue) Less(i, j int) bool {
-	if b[i].Price == b[j].Price {
-		return b[i].Timestamp.Before(b[j].Timestamp)
+func NewOrderBook(symbol string) *OrderBook {
+	return &OrderBook{
+		Symbol:       symbol,
+		Bids:         NewBookSide(true),
+		Asks:         NewBookSide(false),
+		Stops:        NewStopQueue(),
+		orders:       make(map[string]*OrderNode),
+		messages:     make(map[string]uint64),
+		clientOrders: newClientOrderIndex(symbol),
 	}
-	return b[i].Price > b[j].Price
 }
 
-func (b *BidsQueue) Push(x interface{}) {
-	*b = append(*b, x.(*OrderNode))
+func (ob *OrderBook) GetMidPrice() decimal.Decimal {
+	if ob.Asks.Len() == 0 || ob.Bids.Len() == 0 {
+		return decimal.Zero
+	}
+	return ob.Asks.BestPrice().Add(ob.Bids.BestPrice()).Div(decimal.NewFromInt(2))
 }
 
-func (b *BidsQueue) Pop() interface{} {
-	old := *b
-	n := len(old)
-	x := old[n-1]
-	*b = old[0 : n-1]
-	return x
+func (ob *OrderBook) GetOrder(orderID string) *OrderNode {
+	return ob.orders[orderID]
 }
 
-type AsksQueue []*OrderNode
-
-func (a AsksQueue) Len() int      { return len(a) }
-func (a AsksQueue) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a AsksQueue) Less(i, j int) bool {
-	if a[i].Price == a[j].Price {
-		return a[i].Timestamp.Before(a[j].Timestamp)
+// restOrder puts the unfilled remainder of the order on its side of the book.
+func (ob *OrderBook) restOrder(order *models.Order) {
+	node := &OrderNode{
+		Price:     order.Price,
+		Quantity:  visibleQuantity(order),
+		OrderID:   order.ID,
+		UserID:    order.UserID,
+		Timestamp: order.Timestamp,
+		Order:     order,
 	}
-	return a[i].Price < a[j].Price
-}
-func (a *AsksQueue) Push(x interface{}) {
-	*a = append(*a, x.(*OrderNode))
+	if order.FilledQuantity.IsZero() {
+		order.Status = types.Open
+	}
+	ob.side(order.Side).Add(node)
+	ob.orders[order.ID] = node
 }
 
-func (a *AsksQueue) Pop() interface{} {
-	old := *a
-	n := len(old)
-	x := old[n-1]
-	*a = old[0 : n-1]
-	return x
+func (ob *OrderBook) removeOrder(orderID string) *OrderNode {
+	node, ok := ob.orders[orderID]
+	if !ok {
+		return nil
+	}
+	ob.side(node.Order.Side).Remove(node)
+	delete(ob.orders, orderID)
+	return node
 }
 
-type StopQueue struct {
-	Orders []*models.Order
+// side returns the side of the book orders of the given side rest on.
+func (ob *OrderBook) side(side types.Side) *BookSide {
+	if side == types.Buy {
+		return ob.Bids
+	}
+	return ob.Asks
 }
 
-type OrderBook struct {
-	Symbol string
-	Bids   BidsQueue
-	Asks   AsksQueue
-	Stops  *StopQueue
+type MatchingEngine struct {
+	workers         map[string]*bookWorker
+	positionManager *position.PositionManager
+	instruments     *instrument.Registry
+	journal         journal.Journal
+	snapshots       snapshot.Store
+	clientOrders    *clientOrderOwners
+	positionModes   *positionModeLocks
+	closed          bool
+	stopping        chan struct{} // closed by Shutdown
+	mutex           sync.RWMutex
 }
 
-func NewOrderBook(symbol string) *OrderBook {
-	return &OrderBook{
-		Symbol: symbol,
-		Bids:   make(BidsQueue, 0),
-		Asks:   make(AsksQueue, 0),
-		Stops:  &StopQueue{Orders: []*models.Order{}},
+// NewMatchingEngine creates an engine; journal and snapshots may be nil to run without persistence.
+func NewMatchingEngine(positionManager *position.PositionManager, instruments *instrument.Registry, journal journal.Journal, snapshots snapshot.Store) *MatchingEngine {
+	return &MatchingEngine{
+		workers:         make(map[string]*bookWorker),
+		positionManager: positionManager,
+		instruments:     instruments,
+		journal:         journal,
+		snapshots:       snapshots,
+		clientOrders:    newClientOrderOwners(),
+		positionModes:   newPositionModeLocks(),
+		stopping:        make(chan struct{}),
 	}
 }
 
-func (ob *OrderBook) GetMidPrice() float64 {
-	if len(ob.Asks) == 0 || len(ob.Bids) == 0 {
-		return 0.0
+func (m *MatchingEngine) GetCurrentPrice(symbol string) decimal.Decimal {
+	price := decimal.Zero
+	err := m.submit(symbol, &command{kind: queryCommand, query: func(ob *OrderBook) {
+		price = ob.GetMidPrice()
+	}})
+	if err != nil {
+		return decimal.Zero
 	}
-	return (ob.Asks[0].Price + ob.Bids[0].Price) / 2
+	return price
 }
 
-type MatchingEngine struct {
-	orderBooks      map[string]*OrderBook
-	positionManager *position.PositionManager
-}
+func (m *MatchingEngine) PlaceOrder(order *models.Order, publisher message.Publisher) error {
+	// the user is read under the lock, so the order is validated against the current position mode
+	lock := m.positionModes.get(order.UserID)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	user, err := u.GlobalUserService.GetUser(order.UserID)
+	if err != nil {
+		return err
+	}
+
+	release, err := m.claimClientOrders(order)
+	if err != nil {
+		return err
+	}
+	defer release()
 
-func (m *MatchingEngine) GetOrderBook(symbol string) *OrderBook {
-	if ob, ok := m.orderBooks[symbol]; ok {
-		return ob
+	// the book keeps the order it is given and goes on filling it, so it gets its own copy
+	placed := *order
+	if placed.Timestamp.IsZero() {
+		placed.Timestamp = time.Now()
 	}
-	ob := NewOrderBook(symbol)
-	m.orderBooks[symbol] = ob
-	return ob
+	return m.submit(order.Symbol, &command{kind: placeCommand, order: &placed, callerOrders: []*models.Order{order}, user: user, publisher: publisher})
 }
 
-func (m *MatchingEngine) GetCurrentPrice(symbol string) float64 {
-	ob := m.GetOrderBook(symbol)
-	return ob.GetMidPrice()
+// placeOrder accepts an order into the book. A submission repeating an order placed with the same
+// client order id is not placed again: the order is overwritten with the current state of the original.
+func (m *MatchingEngine) placeOrder(ob *OrderBook, order *models.Order, user *models.User, publisher message.Publisher) error {
+	original, err := ob.findDuplicate(order)
+	if err != nil {
+		return err
+	}
+	if original != nil {
+		*order = *original
+		return nil
+	}
+	if err := m.validateOrder(ob, order, user); err != nil {
+		return err
+	}
+	if err := m.startListingAuction(ob); err != nil {
+		return err
+	}
+	if err := m.record(ob, &journal.Entry{Type: journal.Place, Order: order}); err != nil {
+		return err
+	}
+	return m.applyOrder(ob, order, publisher)
 }
 
-func (m *MatchingEngine) PlaceOrder(order *models.Order, publisher message.Publisher) error {
-	// todo: validate order
-	user, err := u.GlobalUserService.GetUser(order.UserID)
+func (m *MatchingEngine) validateOrder(ob *OrderBook, order *models.Order, user *models.User) error {
+	inst, err := m.instruments.Get(order.Symbol)
 	if err != nil {
 		return err
 	}
+	if err := ob.checkOrderID(order.ID); err != nil {
+		return err
+	}
+	if err := validatePositionSide(user, order); err != nil {
+		return err
+	}
+	if err := m.checkReduceOnly(order); err != nil {
+		return err
+	}
+	if err := instrument.ValidateOrder(inst, order, getEntryPrice(ob, order)); err != nil {
+		return err
+	}
+	if order.Type == types.Limit {
+		if err := instrument.CheckPriceBand(inst, order.Price, ob.bandReference()); err != nil {
+			return err
+		}
+	}
 
 	if user.MarginMode == types.IsolatedMargin && order.Type != types.Market && order.Type != types.Limit {
 		return errors.New("only market and limit order are supported on isolated margin mode")
 	}
 
-	ob := m.GetOrderBook(order.Symbol)
-	if user.MarginMode == types.CrossMargin {
-		if err := m.checkCrossMargin(user, order); err != nil {
+	switch {
+	case closesPosition(order):
+		// closing orders only release margin, so they need no free balance
+	case user.MarginMode == types.CrossMargin:
+		if err := checkCrossMargin(ob, user, order); err != nil {
 			return err
 		}
-	} else {
-		if err := m.checkIsolatedMargin(user, order); err != nil {
+	default:
+		if err := checkIsolatedMargin(ob, user, order); err != nil {
 			return err
 		}
 	}
 
-	orderJson, err := json.Marshal(order)
-	if err != nil {
+	if err := validateSelfTradePrevention(order); err != nil {
+		return err
+	}
+	if err := validateWorkingType(order); err != nil {
+		return err
+	}
+	if err := validateTimeInForce(order); err != nil {
+		return err
+	}
+
+	// the slippage limit is fixed before the order is journaled so replay fills it the same way
+	if order.Type == types.Market {
+		order.Price = instrument.MarketPriceLimit(inst, order.Side, getEntryPrice(ob, order))
+	}
+	return nil
+}
+
+// checkOrderID rejects an order without an id or with the id of an open order of the book,
+// since the book, its stops, bracket legs and the journal all address orders by id.
+func (ob *OrderBook) checkOrderID(orderID string) error {
+	if orderID == "" {
+		return errors.New("order id is required")
+	}
+	if ob.orders[orderID] != nil || ob.Stops.Get(orderID) != nil {
+		return errors.New("order id is already used by an open order: " + orderID)
+	}
+	for _, leg := range ob.pendingLegs() {
+		if leg.ID == orderID {
+			return errors.New("order id is already used by an open order: " + orderID)
+		}
+	}
+	return nil
+}
+
+// applyOrder enters an accepted order into the book. It must stay deterministic as it is also used by replay.
+func (m *MatchingEngine) applyOrder(ob *OrderBook, order *models.Order, publisher message.Publisher) error {
+	ob.clientOrders.add(order)
+	if err := publishOrder("orders", order, publisher); err != nil {
 		return err
 	}
 
-	err = publisher.Publish("orders", message.NewMessage(uuid.New().String(), orderJson))
+	var err error
 	switch order.Type {
 	case types.Limit:
 		err = m.handleLimitOrder(ob, order, publisher)
 	case types.Market:
 		err = m.handleMarketOrder(ob, order, publisher)
-	case types.LimitStopLoss, types.LimitTakeProfit, types.MarketStopLoss, types.MarketTakeProfit:
-		ob.Stops.Orders = append(ob.Stops.Orders, order)
+	case types.LimitStopLoss, types.LimitTakeProfit, types.MarketStopLoss, types.MarketTakeProfit, types.TrailingStop:
+		ob.Stops.Add(order)
+		ob.checkStops = true
 		order.Status = types.Pending
 	}
 
 	return err
 }
 
-func (m *MatchingEngine) checkCrossMargin(user *models.User, order *models.Order) error {
-	entryPrice := m.GetCurrentPrice(order.Symbol)
-	if entryPrice == 0.0 {
+// getEntryPrice returns the price used for margin checks: the limit price for limit orders,
+// the best opposite price for market orders and the trigger price for stop orders.
+func getEntryPrice(ob *OrderBook, order *models.Order) decimal.Decimal {
+	switch order.Type {
+	case types.Limit, types.LimitStopLoss, types.LimitTakeProfit:
+		return order.Price
+	case types.MarketStopLoss, types.MarketTakeProfit:
+		return order.StopPrice
+	case types.TrailingStop:
+		if !order.ActivationPrice.IsZero() {
+			return order.ActivationPrice
+		}
+	}
+
+	if order.Side == types.Buy {
+		return ob.Asks.BestPrice()
+	}
+	return ob.Bids.BestPrice()
+}
+
+func checkCrossMargin(ob *OrderBook, user *models.User, order *models.Order) error {
+	entryPrice := getEntryPrice(ob, order)
+	if entryPrice.IsZero() {
 		return errors.New("cannot get current price")
 	}
 
-	margin := (order.Quantity * entryPrice) / float64(order.Leverage)
+	margin := order.Quantity.Mul(entryPrice).Div(decimal.NewFromInt(int64(order.Leverage)))
 	totalMargin := margin
 	for _, p := range user.Positions {
-		pMargin := (p.Quantity * p.EntryPrice) / float64(p.Leverage)
-		totalMargin += pMargin
+		pMargin := p.Quantity.Mul(p.EntryPrice).Div(decimal.NewFromInt(int64(p.Leverage)))
+		totalMargin = totalMargin.Add(pMargin)
 	}
 
-	if totalMargin > user.TotalBalance {
+	if totalMargin.GreaterThan(user.TotalBalance) {
 		return errors.New("insufficient balance to open position")
 	}
 	return nil
 }
 
-func (m *MatchingEngine) checkIsolatedMargin(user *models.User, order *models.Order) error {
-	entryPrice := m.GetCurrentPrice(order.Symbol)
-	if entryPrice == 0.0 {
+func checkIsolatedMargin(ob *OrderBook, user *models.User, order *models.Order) error {
+	entryPrice := getEntryPrice(ob, order)
+	if entryPrice.IsZero() {
 		return errors.New("cannot get current price")
 	}
 
-	allocatedMargin := order.Quantity * entryPrice * 0.1
-	currentSumAllocated := 0.0
+	allocatedMargin := order.Quantity.Mul(entryPrice).Mul(decimal.New(1, -1))
+	currentSumAllocated := decimal.Zero
 	for _, p := range user.Positions {
-		currentSumAllocated += p.AllocatedMargin
+		currentSumAllocated = currentSumAllocated.Add(p.AllocatedMargin)
 	}
-	if user.TotalBalance < currentSumAllocated+allocatedMargin {
+	if user.TotalBalance.LessThan(currentSumAllocated.Add(allocatedMargin)) {
 		return errors.New("insufficient balance to open position")
 	}
 	return nil
 }
 
-func (m *MatchingEngine) handleLimitOrder(ob *OrderBook, order *models.Order, publisher message.Publisher) error {
-	var err error
-	if order.Side == types.Buy {
-		err = m.matchBuyLimit(ob, order, publisher)
-	} else if order.Side == types.Sell {
-		err = m.matchSellLimit(ob, order, publisher)
+func validateTimeInForce(order *models.Order) error {
+	if order.TimeInForce == "" {
+		order.TimeInForce = types.GTC
 	}
-	return err
+	switch order.TimeInForce {
+	case types.GTC, types.IOC, types.FOK:
+	case types.GTD:
+		if !order.ExpireTime.After(order.Timestamp) {
+			return errors.New("good-till-date order requires a future expire time")
+		}
+	case types.PostOnly:
+		if order.Type != types.Limit {
+			return errors.New("post-only is only supported on limit orders")
+		}
+	default:
+		return errors.New("unknown time in force: " + string(order.TimeInForce))
+	}
+	return nil
 }
 
-func (m *MatchingEngine) matchBuyLimit(ob *OrderBook, order *models.Order, publisher message.Publisher) error {
-	markPrice := m.GetCurrentPrice(order.Symbol)
-	if markPrice == 0.0 {
-		return errors.New("cannot get current price")
-	}
-	if order.Price < markPrice {
-		node := &OrderNode{
-			Price:     order.Price,
-			Quantity:  order.Quantity,
-			OrderID:   order.ID,
-			UserID:    order.UserID,
-			Timestamp: order.Timestamp,
-		}
-		order.Status = types.Pending
-		heap.Push(&ob.Bids, node)
+func (m *MatchingEngine) handleLimitOrder(ob *OrderBook, order *models.Order, publisher message.Publisher) error {
+	if ob.auction {
+		ob.restOrder(order)
 		return nil
 	}
-
-	trade := &models.Trade{
-		ID:        uuid.New().String(),
-		Symbol:    order.Symbol,
-		BuyerID:   types.SystemID,
-		SellerID:  order.ID,
-		Price:     markPrice,
-		Quantity:  order.Quantity,
-		Timestamp: order.Timestamp,
+	switch order.TimeInForce {
+	case types.PostOnly:
+		if crossesBook(ob, order) {
+			return rejectOrder(order, errors.New("post-only order would take liquidity"), publisher)
+		}
+	case types.FOK:
+		if !fillsCompletely(ob, order) {
+			return rejectOrder(order, errors.New("fill-or-kill order cannot be filled completely"), publisher)
+		}
 	}
 
-	tradeJson, err := json.Marshal(trade)
-	if err != nil {
+	if err := m.match(ob, order, publisher); err != nil {
 		return err
 	}
-	err = publisher.Publish("trades", message.NewMessage(uuid.New().String(), tradeJson))
-	if err != nil {
-		return err
+	if order.Status != types.Filled && order.Status != types.Cancelled {
+		return restOrCancel(ob, order, publisher)
 	}
-	order.Status = types.Filled
-	heap.Pop(&ob.Bids)
-
 	return nil
 }
 
-func (m *MatchingEngine) matchSellLimit(ob *OrderBook, order *models.Order, publisher message.Publisher) error {
-	markPrice := m.GetCurrentPrice(order.Symbol)
-	if markPrice == 0.0 {
-		return errors.New("cannot get current price")
+func (m *MatchingEngine) handleMarketOrder(ob *OrderBook, order *models.Order, publisher message.Publisher) error {
+	if err := m.match(ob, order, publisher); err != nil {
+		return err
 	}
 
-	if order.Price > markPrice {
-		node := &OrderNode{
-			Price:     order.Price,
-			Quantity:  order.Quantity,
-			OrderID:   order.ID,
-			UserID:    order.UserID,
-			Timestamp: order.Timestamp,
-		}
-		order.Status = types.Open
-		heap.Push(&ob.Asks, node)
-		return nil
+	// market orders never rest, the unfilled remainder is cancelled
+	if order.Status != types.Filled && order.Status != types.Cancelled {
+		order.Status = types.Cancelled
+		return publishOrder("order_cancelled", order, publisher)
 	}
+	return nil
+}
 
-	trade := &models.Trade{
-		ID:        uuid.New().String(),
-		Symbol:    order.Symbol,
-		BuyerID:   types.SystemID,
-		SellerID:  order.ID,
-		Price:     order.Price,
-		Quantity:  order.Quantity,
-		Timestamp: time.Now(),
+// restOrCancel rests the unfilled remainder of a limit order on the book,
+// or cancels it when the time in force does not allow resting.
+func restOrCancel(ob *OrderBook, order *models.Order, publisher message.Publisher) error {
+	if order.TimeInForce == types.IOC || order.TimeInForce == types.FOK {
+		order.Status = types.Cancelled
+		return publishOrder("order_cancelled", order, publisher)
 	}
-	tradeJson, err := json.Marshal(trade)
-	if err != nil {
+	ob.restOrder(order)
+	return nil
+}
+
+func rejectOrder(order *models.Order, reason error, publisher message.Publisher) error {
+	order.Status = types.Cancelled
+	if err := publishOrder("order_cancelled", order, publisher); err != nil {
 		return err
 	}
-	err = publisher.Publish("trades", message.NewMessage(uuid.New().String(), tradeJson))
-	if err != nil {
-		return err
+	return reason
+}
+
+// crossesBook reports whether a limit order would immediately match against the opposite side.
+func crossesBook(ob *OrderBook, order *models.Order) bool {
+	if order.Side == types.Buy {
+		return ob.Asks.Len() > 0 && ob.Asks.BestPrice().LessThanOrEqual(order.Price)
 	}
+	return ob.Bids.Len() > 0 && ob.Bids.BestPrice().GreaterThanOrEqual(order.Price)
+}
 
-	order.Status = types.Filled
-	heap.Pop(&ob.Asks)
+// fillsCompletely reports whether a limit order would be filled in full by the opposite side
+// at its price. It walks the book the way match would: iceberg orders only
+// show one slice at a time and rejoin the back of their level for the next, and self-trade
+// prevention cancels the order, skips the maker or decrements the order when it meets one of
+// its own orders. Nothing on the book is changed.
+func fillsCompletely(ob *OrderBook, order *models.Order) bool {
+	type resting struct {
+		node      *OrderNode
+		visible   decimal.Decimal
+		remaining decimal.Decimal
+	}
+
+	side := ob.Asks
+	if order.Side == types.Sell {
+		side = ob.Bids
+	}
+	need := remainingQuantity(order)
+	filled := false
+	side.Each(func(level *PriceLevel) bool {
+		if order.Side == types.Buy && level.Price.GreaterThan(order.Price) ||
+			order.Side == types.Sell && level.Price.LessThan(order.Price) {
+			return false
+		}
+		queue := make([]*resting, 0, level.Len())
+		for _, node := range level.Orders() {
+			queue = append(queue, &resting{node: node, visible: node.Quantity, remaining: remainingQuantity(node.Order)})
+		}
+		for len(queue) > 0 {
+			maker := queue[0]
+			queue = queue[1:]
+			if isSelfTrade(order, maker.node) {
+				switch order.STPMode {
+				case types.STPCancelNewest, types.STPCancelBoth:
+					return false
+				case types.STPDecrementAndCancel:
+					// the order is cut down as well, or cancelled once nothing is left of it
+					quantity := decimal.Min(need, maker.remaining)
+					need = need.Sub(quantity)
+					if !need.IsPositive() {
+						return false
+					}
+				}
+				continue
+			}
 
-	return nil
+			quantity := decimal.Min(need, maker.visible)
+			need = need.Sub(quantity)
+			if !need.IsPositive() {
+				filled = true
+				return false
+			}
+			maker.remaining = maker.remaining.Sub(quantity)
+			if maker.remaining.IsPositive() {
+				maker.visible = maker.remaining
+				if display := maker.node.Order.DisplayQuantity; display.IsPositive() {
+					maker.visible = decimal.Min(display, maker.remaining)
+				}
+				queue = append(queue, maker)
+			}
+		}
+		return true
+	})
+	return filled
 }
 
-func (m *MatchingEngine) handleMarketOrder(ob *OrderBook, order *models.Order, publisher message.Publisher) error {
-	markPrice := m.GetCurrentPrice(order.Symbol)
-	if markPrice == 0.0 {
-		return errors.New("cannot get current price")
+func remainingQuantity(order *models.Order) decimal.Decimal {
+	return order.Quantity.Sub(order.FilledQuantity)
+}
+
+// fillOrder records an execution against the order and keeps its volume-weighted average price.
+func fillOrder(order *models.Order, quantity, price decimal.Decimal) {
+	filled := order.FilledQuantity.Add(quantity)
+	order.AveragePrice = order.AveragePrice.Mul(order.FilledQuantity).Add(price.Mul(quantity)).Div(filled)
+	order.FilledQuantity = filled
+	if order.FilledQuantity.GreaterThanOrEqual(order.Quantity) {
+		order.Status = types.Filled
+	} else {
+		order.Status = types.PartiallyFilled
 	}
+}
 
-	if order.Side == types.Buy {
-		trade := &models.Trade{
-			ID:        uuid.New().String(),
-			Symbol:    order.Symbol,
-			BuyerID:   order.UserID,
-			SellerID:  types.SystemID,
-			Price:     markPrice,
-			Quantity:  order.Quantity,
-			Timestamp: time.Now(),
+// fillResting fills a resting order, taking it off the book once its reserve is used up.
+func (ob *OrderBook) fillResting(node *OrderNode, quantity, price decimal.Decimal) {
+	fillOrder(node.Order, quantity, price)
+	side := ob.side(node.Order.Side)
+	side.Reduce(node, quantity)
+	if node.Quantity.IsZero() && !ob.replenish(node) {
+		side.Remove(node)
+		delete(ob.orders, node.OrderID)
+	}
+}
+
+// match crosses an order against the resting orders of the opposite side in price-time
+// priority, filling at each maker's price until the order is filled or no longer crosses.
+func (m *MatchingEngine) match(ob *OrderBook, order *models.Order, publisher message.Publisher) error {
+	makers := ob.Asks
+	if order.Side == types.Sell {
+		makers = ob.Bids
+	}
+	for remainingQuantity(order).IsPositive() && order.Status != types.Cancelled && makers.Len() > 0 {
+		maker := makers.Front()
+		// market orders carry a price too when slippage protection applies
+		if !order.Price.IsZero() && makers.before(order.Price, maker.Price) {
+			break
 		}
-		tradJson, err := json.Marshal(trade)
-		if err != nil {
+		if isSelfTrade(order, maker) {
+			if err := preventSelfTrade(ob, order, maker, publisher); err != nil {
+				return err
+			}
+			continue
+		}
+		// closing orders may have outgrown their position since they were placed
+		if err := m.clipClosing(ob, maker.Order, publisher); err != nil {
 			return err
 		}
-
-		err = publisher.Publish("trades", message.NewMessage(uuid.New().String(), tradJson))
-		if err != nil {
+		if maker.Order.Status == types.Cancelled {
+			continue
+		}
+		if err := m.clipClosing(ob, order, publisher); err != nil || order.Status == types.Cancelled {
 			return err
 		}
 
-		m.positionManager.UpdatePositionFromTrade(trade, order.Leverage, order.MarginType)
-		order.Quantity = 0.0
-		order.Status = types.Filled
-		heap.Pop(&ob.Bids)
-	} else if order.Side == types.Sell {
+		quantity := decimal.Min(remainingQuantity(order), maker.Quantity)
 		trade := &models.Trade{
 			ID:        uuid.New().String(),
 			Symbol:    order.Symbol,
-			BuyerID:   types.SystemID,
-			SellerID:  order.UserID,
-			Price:     markPrice,
-			Quantity:  order.Quantity,
+			BuyerID:   order.UserID,
+			SellerID:  maker.UserID,
+			Price:     maker.Price,
+			Quantity:  quantity,
 			Timestamp: time.Now(),
 		}
-		tradJson, err := json.Marshal(trade)
-		if err != nil {
-			return err
+		if order.Side == types.Sell {
+			trade.BuyerID, trade.SellerID = maker.UserID, order.UserID
 		}
-
-		err = publisher.Publish("trades", message.NewMessage(uuid.New().String(), tradJson))
-		if err != nil {
+		fillOrder(order, quantity, maker.Price)
+		ob.fillResting(maker, quantity, maker.Price)
+		if err := m.settleTrade(ob, trade, order, maker, publisher); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		m.positionManager.UpdatePositionFromTrade(trade, order.Leverage, order.MarginType)
-		order.Quantity = 0.0
-		order.Status = types.Filled
-		heap.Pop(&ob.Asks)
+// settleTrade publishes a trade and applies it to the taker's and maker's positions.
+// Both orders are already filled in the book, which replay rebuilds from the journal
+// alone, so a failed position update is logged rather than undoing the match.
+func (m *MatchingEngine) settleTrade(ob *OrderBook, trade *models.Trade, taker *models.Order, maker *OrderNode, publisher message.Publisher) error {
+	ob.LastPrice = trade.Price
+	ob.checkStops = true
+	tradeJson, err := json.Marshal(trade)
+	if err != nil {
+		return err
+	}
+	err = publisher.Publish("trades", message.NewMessage(uuid.New().String(), tradeJson))
+	if err != nil {
+		return err
 	}
 
+	// positions were already updated when the trade first happened
+	if ob.replaying {
+		return nil
+	}
+	ob.breaker.record(trade.Price, trade.Timestamp)
+
+	if err := m.positionManager.UpdatePositionFromTrade(trade, taker.UserID, taker.Side, taker.PositionSide, taker.Leverage, taker.MarginType); err != nil {
+		log.Println("failed to settle trade", trade.ID, "for user", taker.UserID, err)
+	}
+	if err := m.positionManager.UpdatePositionFromTrade(trade, maker.UserID, maker.Order.Side, maker.Order.PositionSide, maker.Order.Leverage, maker.Order.MarginType); err != nil {
+		log.Println("failed to settle trade", trade.ID, "for user", maker.UserID, err)
+	}
 	return nil
 }
 
+// MonitorStops checks the stops of every book against its current prices. Stops also fire
+// after every command that moves a price, so this is only a safety net.
 func (m *MatchingEngine) MonitorStops(publisher message.Publisher) {
-	for _, ob := range m.orderBooks {
-		midPrice := ob.GetMidPrice()
-		for i := 0; i < len(ob.Stops.Orders); i++ {
-			order := ob.Stops.Orders[i]
-			if shouldTriggerStop(order, midPrice) {
-				if order.Type == types.MarketStopLoss || order.Type == types.MarketTakeProfit {
-					marketOrder := &models.Order{
-						ID:         order.ID,
-						UserID:     order.UserID,
-						Symbol:     order.Symbol,
-						Side:       order.Side,
-						Type:       types.Market,
-						Leverage:   order.Leverage,
-						Quantity:   order.Quantity,
-						Price:      0.0,
-						StopPrice:  0,
-						Status:     "",
-						MarginType: order.MarginType,
-						Timestamp:  time.Time{},
-					}
-					m.PlaceOrder(marketOrder, publisher)
-					ob.Stops.Orders = append(ob.Stops.Orders[:i], ob.Stops.Orders[i+1:]...)
-					i--
-				} else if order.Type == types.LimitStopLoss || order.Type == types.LimitTakeProfit {
-					limitOrder := &models.Order{
-						ID:         order.ID,
-						UserID:     order.UserID,
-						Symbol:     order.Symbol,
-						Side:       order.Side,
-						Type:       types.Limit,
-						Leverage:   order.Leverage,
-						Quantity:   order.Quantity,
-						Price:      order.Price,
-						StopPrice:  0,
-						Status:     "",
-						MarginType: order.MarginType,
-						Timestamp:  time.Now(),
-					}
-					m.PlaceOrder(limitOrder, publisher)
-					ob.Stops.Orders = append(ob.Stops.Orders[:i], ob.Stops.Orders[i+1:]...)
-					i--
-				}
-			}
+	if err := m.broadcast(command{kind: triggerCommand, publisher: publisher}); err != nil {
+		log.Println("failed to monitor stops", err)
+	}
+}
+
+// triggerStops fires every stop triggered at the current prices of the book. A triggered
+// stop may trade and move the last price, so the next stop is looked up again after each
+// one: cascades are processed one stop at a time, in the order StopQueue.next defines.
+func (m *MatchingEngine) triggerStops(ob *OrderBook, publisher message.Publisher) {
+	ob.checkStops = false
+	for {
+		if !m.isTrading(ob) {
+			// stops wait until trading resumes instead of firing into a halted book
+			ob.checkStops = true
+			return
+		}
+		m.trailStops(ob)
+		order := ob.Stops.next(ob.triggerPrice)
+		if order == nil {
+			return
 		}
+
+		// the triggered order is a clone of the stop, so it keeps every field but the trigger
+		// and the group it was waiting in: the group resolves on the stop itself
+		clone := *order
+		triggered := &clone
+		triggered.StopPrice = decimal.Zero
+		triggered.WorkingType = ""
+		triggered.CallbackRate = decimal.Zero
+		triggered.TrailingDelta = decimal.Zero
+		triggered.ActivationPrice = decimal.Zero
+		triggered.Watermark = decimal.Zero
+		triggered.Status = ""
+		triggered.ParentID = ""
+		triggered.OCOGroupID = ""
+		triggered.Timestamp = time.Now()
+		if order.Type == types.MarketStopLoss || order.Type == types.MarketTakeProfit || order.Type == types.TrailingStop {
+			triggered.Type = types.Market
+			triggered.Price = decimal.Zero
+		} else {
+			triggered.Type = types.Limit
+			triggered.Price = order.Price
+		}
+		ob.Stops.Remove(order.ID)
+
+		if err := m.triggerStop(ob, order, triggered, publisher); err != nil {
+			log.Println("failed to place triggered stop", order.ID, err)
+		}
+		if err := m.resolveGroups(ob, publisher); err != nil {
+			log.Println("failed to resolve order groups", err)
+		}
+		m.checkCircuitBreaker(ob, publisher)
 	}
 }
 
-func shouldTriggerStop(order *models.Order, currentPrice float64) bool {
+// triggerStop journals a triggered stop together with the order it turns into, or without
+// one when that order is rejected, so replay does not depend on balances at trigger time.
+func (m *MatchingEngine) triggerStop(ob *OrderBook, stop, triggered *models.Order, publisher message.Publisher) error {
+	user, err := u.GlobalUserService.GetUser(stop.UserID)
+	if err == nil {
+		err = m.validateOrder(ob, triggered, user)
+	}
+	if err != nil {
+		if recordErr := m.record(ob, &journal.Entry{Type: journal.Trigger, OrderID: stop.ID}); recordErr != nil {
+			return recordErr
+		}
+		return rejectOrder(stop, err, publisher)
+	}
+
+	if err := m.record(ob, &journal.Entry{Type: journal.Trigger, OrderID: stop.ID, Order: triggered}); err != nil {
+		return err
+	}
+	stop.Status = types.Triggered
+	return m.applyOrder(ob, triggered, publisher)
+}
+
+func shouldTriggerStop(order *models.Order, currentPrice decimal.Decimal) bool {
 	if order.Type == types.LimitStopLoss || order.Type == types.MarketStopLoss {
-		if order.Side == types.Buy && currentPrice >= order.StopPrice {
+		if order.Side == types.Buy && currentPrice.GreaterThanOrEqual(order.StopPrice) {
+			return true
+		}
+		if order.Side == types.Sell && currentPrice.LessThanOrEqual(order.StopPrice) {
+			return true
+		}
+	}
+	if order.Type == types.TrailingStop && !order.Watermark.IsZero() {
+		if order.Side == types.Buy && currentPrice.GreaterThanOrEqual(order.StopPrice) {
 			return true
 		}
-		if order.Side == types.Sell && currentPrice <= order.StopPrice {
+		if order.Side == types.Sell && currentPrice.LessThanOrEqual(order.StopPrice) {
 			return true
 		}
 	}
 	if order.Type == types.LimitTakeProfit || order.Type == types.MarketTakeProfit {
-		if order.Side == types.Buy && currentPrice <= order.StopPrice {
+		if order.Side == types.Buy && currentPrice.LessThanOrEqual(order.StopPrice) {
 			return true
 		}
-		if order.Side == types.Sell && currentPrice >= order.StopPrice {
+		if order.Side == types.Sell && currentPrice.GreaterThanOrEqual(order.StopPrice) {
 			return true
 		}
 	}
@@ -0,0 +1,418 @@
+package matching
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/instrument"
+	"github.com/xhcdpg/crypto-trade/journal"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/position"
+	"github.com/xhcdpg/crypto-trade/snapshot"
+	"github.com/xhcdpg/crypto-trade/types"
+	u "github.com/xhcdpg/crypto-trade/user"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testUsers backs the users table of the engine under test. Users are created on first
+// use in one-way cross margin mode with a balance large enough for every test order.
+var testUsers = struct {
+	sync.Mutex
+	rows map[string]*testUser
+}{rows: make(map[string]*testUser)}
+
+type testUser struct {
+	balance      decimal.Decimal
+	positionMode types.PositionMode
+}
+
+func getTestUser(id string) *testUser {
+	testUsers.Lock()
+	defer testUsers.Unlock()
+	user, ok := testUsers.rows[id]
+	if !ok {
+		user = &testUser{balance: decimal.NewFromInt(1000000), positionMode: types.OneWay}
+		testUsers.rows[id] = user
+	}
+	return user
+}
+
+func setBalance(id string, balance decimal.Decimal) {
+	user := getTestUser(id)
+	testUsers.Lock()
+	user.balance = balance
+	testUsers.Unlock()
+}
+
+// testDriver answers the few statements the user service runs.
+type testDriver struct{}
+type testConn struct{}
+type testStmt struct{ query string }
+type testRows struct {
+	values []driver.Value
+	done   bool
+}
+
+func (testDriver) Open(string) (driver.Conn, error)        { return testConn{}, nil }
+func (testConn) Prepare(query string) (driver.Stmt, error) { return &testStmt{query}, nil }
+func (testConn) Close() error                              { return nil }
+func (testConn) Begin() (driver.Tx, error)                 { return nil, io.EOF }
+func (s *testStmt) Close() error                           { return nil }
+func (s *testStmt) NumInput() int                          { return -1 }
+
+func (s *testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	switch {
+	case strings.Contains(s.query, "total_balance = total_balance + $1"):
+		amount := decimal.RequireFromString(args[0].(string))
+		user := getTestUser(args[1].(string))
+		testUsers.Lock()
+		user.balance = user.balance.Add(amount)
+		testUsers.Unlock()
+	case strings.Contains(s.query, "position_mode = $1"):
+		user := getTestUser(args[1].(string))
+		testUsers.Lock()
+		user.positionMode = types.PositionMode(args[0].(string))
+		testUsers.Unlock()
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	id := args[0].(string)
+	user := getTestUser(id)
+	testUsers.Lock()
+	defer testUsers.Unlock()
+	return &testRows{values: []driver.Value{id, id, id, "", user.balance.String(), string(types.CrossMargin), string(user.positionMode)}}, nil
+}
+
+func (r *testRows) Columns() []string {
+	return []string{"id", "username", "email", "password_hashed", "total_balance", "margin_mode", "position_mode"}
+}
+func (r *testRows) Close() error { return nil }
+func (r *testRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	copy(dest, r.values)
+	return nil
+}
+
+var registerDriver sync.Once
+
+// testPublisher keeps every published message by topic.
+type testPublisher struct {
+	mutex    sync.Mutex
+	messages map[string][]*message.Message
+}
+
+func (p *testPublisher) Publish(topic string, messages ...*message.Message) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.messages[topic] = append(p.messages[topic], messages...)
+	return nil
+}
+
+func (p *testPublisher) Close() error { return nil }
+
+// metadata returns the metadata value of every message published on topic.
+func (p *testPublisher) metadata(topic, key string) []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var values []string
+	for _, msg := range p.messages[topic] {
+		values = append(values, msg.Metadata.Get(key))
+	}
+	return values
+}
+
+func (p *testPublisher) count(topic string) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.messages[topic])
+}
+
+const (
+	testSymbol  = "BTCUSDT"
+	otherSymbol = "ETHUSDT"
+)
+
+type testEngine struct {
+	*MatchingEngine
+	positions *position.PositionManager
+	publisher *testPublisher
+	journal   journal.Journal
+	snapshots snapshot.Store
+}
+
+// restart shuts the engine down and recovers a new one from its journal and snapshots.
+func (e *testEngine) restart(t *testing.T) {
+	t.Helper()
+	if err := e.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	e.MatchingEngine = NewMatchingEngine(e.positions, e.instruments, e.journal, e.snapshots)
+	if err := e.Recover(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestEngine starts an engine trading testSymbol and otherSymbol, journaling into a temporary directory.
+func newTestEngine(t *testing.T) *testEngine {
+	registerDriver.Do(func() { sql.Register("matching_test", testDriver{}) })
+	db, err := sql.Open("matching_test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.NewUserService(db)
+	testUsers.Lock()
+	testUsers.rows = make(map[string]*testUser)
+	testUsers.Unlock()
+
+	instruments := instrument.NewRegistry()
+	for _, symbol := range []string{testSymbol, otherSymbol} {
+		err = instruments.Register(&models.Instrument{
+			Symbol:      symbol,
+			TickSize:    decimal.RequireFromString("0.1"),
+			LotSize:     decimal.RequireFromString("0.001"),
+			MinQuantity: decimal.RequireFromString("0.001"),
+			MaxLeverage: 100,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := t.TempDir()
+	fileJournal, err := journal.NewFileJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := snapshot.NewFileStore(dir + "/snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := &testPublisher{messages: make(map[string][]*message.Message)}
+	positions := position.NewPositionManager(publisher)
+	engine := &testEngine{
+		MatchingEngine: NewMatchingEngine(positions, instruments, fileJournal, store),
+		positions:      positions,
+		publisher:      publisher,
+		journal:        fileJournal,
+		snapshots:      store,
+	}
+	t.Cleanup(func() { engine.Shutdown(context.Background()) })
+	return engine
+}
+
+var testOrderID int
+
+func newTestOrder(userID string, side types.Side, orderType types.OrderType, price, quantity string) *models.Order {
+	testOrderID++
+	order := &models.Order{
+		ID:         "order-" + decimal.NewFromInt(int64(testOrderID)).String(),
+		UserID:     userID,
+		Symbol:     testSymbol,
+		Side:       side,
+		Type:       orderType,
+		Leverage:   10,
+		Quantity:   decimal.RequireFromString(quantity),
+		MarginType: types.CrossMargin,
+	}
+	if price != "" {
+		order.Price = decimal.RequireFromString(price)
+	}
+	return order
+}
+
+func (e *testEngine) place(t *testing.T, order *models.Order) {
+	t.Helper()
+	if err := e.PlaceOrder(order, e.publisher); err != nil {
+		t.Fatalf("place %s: %v", order.ID, err)
+	}
+}
+
+func (e *testEngine) positionQuantity(userID string, positionSide types.PositionSide) string {
+	current := e.positions.GetPosition(userID, testSymbol, positionSide)
+	if current == nil {
+		return "0"
+	}
+	return current.Quantity.String()
+}
+
+func TestClosingOrderNeedsNoFreeBalance(t *testing.T) {
+	engine := newTestEngine(t)
+	engine.place(t, newTestOrder("maker", types.Sell, types.Limit, "100", "1"))
+	engine.place(t, newTestOrder("alice", types.Buy, types.Limit, "100", "1"))
+	if got := engine.positionQuantity("alice", types.Both); got != "1" {
+		t.Fatalf("position after opening = %s, want 1", got)
+	}
+
+	setBalance("alice", decimal.Zero)
+	if err := engine.PlaceOrder(newTestOrder("alice", types.Buy, types.Limit, "90", "1"), engine.publisher); err == nil {
+		t.Fatal("opening order without balance was accepted")
+	}
+
+	engine.place(t, newTestOrder("taker", types.Buy, types.Limit, "100", "1"))
+	closing := newTestOrder("alice", types.Sell, types.Limit, "100", "1")
+	closing.ReduceOnly = true
+	engine.place(t, closing)
+	if closing.Status != types.Filled {
+		t.Fatalf("closing order status = %s, want %s", closing.Status, types.Filled)
+	}
+	if got := engine.positionQuantity("alice", types.Both); got != "0" {
+		t.Fatalf("position after closing = %s, want 0", got)
+	}
+}
+
+func TestTriggeredStopKeepsExpireTime(t *testing.T) {
+	engine := newTestEngine(t)
+	engine.place(t, newTestOrder("maker", types.Sell, types.Limit, "100", "1"))
+	engine.place(t, newTestOrder("taker", types.Buy, types.Limit, "100", "0.5"))
+
+	stop := newTestOrder("alice", types.Buy, types.LimitStopLoss, "95", "1")
+	stop.StopPrice = decimal.NewFromInt(100)
+	stop.TimeInForce = types.GTD
+	stop.ExpireTime = time.Now().Add(time.Hour)
+	engine.place(t, stop)
+
+	triggered, err := engine.GetOrder(testSymbol, stop.ID, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if triggered.Type != types.Limit || triggered.TimeInForce != types.GTD || !triggered.ExpireTime.Equal(stop.ExpireTime) {
+		t.Fatalf("triggered order = %s %s until %v, want limit GTD until %v", triggered.Type, triggered.TimeInForce, triggered.ExpireTime, stop.ExpireTime)
+	}
+
+	if err := engine.ExpireOrders(stop.ExpireTime, engine.publisher); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.GetOrder(testSymbol, stop.ID, "alice"); err == nil {
+		t.Fatal("triggered order is still open after its expire time")
+	}
+	if got := engine.publisher.count("order_expired"); got != 1 {
+		t.Fatalf("%d orders expired, want 1", got)
+	}
+}
+
+func TestOrderIDMustBeUnique(t *testing.T) {
+	engine := newTestEngine(t)
+	resting := newTestOrder("alice", types.Buy, types.Limit, "90", "1")
+	engine.place(t, resting)
+	stop := newTestOrder("alice", types.Sell, types.MarketStopLoss, "", "1")
+	stop.StopPrice = decimal.NewFromInt(80)
+	engine.place(t, stop)
+
+	for _, id := range []string{"", resting.ID, stop.ID} {
+		order := newTestOrder("bob", types.Buy, types.Limit, "90", "1")
+		order.ID = id
+		if err := engine.PlaceOrder(order, engine.publisher); err == nil {
+			t.Errorf("order with id %q was accepted", id)
+		}
+	}
+	if got := engine.publisher.count("orders"); got != 2 {
+		t.Fatalf("%d orders accepted, want 2", got)
+	}
+}
+
+func TestPlacedOrderIsCopied(t *testing.T) {
+	engine := newTestEngine(t)
+	resting := newTestOrder("maker", types.Sell, types.Limit, "100", "1")
+	engine.place(t, resting)
+	if resting.Status != types.Open || resting.Timestamp.IsZero() {
+		t.Fatalf("placed order = %s at %v, want the state of the book's copy", resting.Status, resting.Timestamp)
+	}
+
+	// the book fills its own copy, the caller's order keeps the state it was returned with
+	taker := newTestOrder("taker", types.Buy, types.Limit, "100", "1")
+	engine.place(t, taker)
+	if taker.Status != types.Filled {
+		t.Fatalf("taker = %s, want %s", taker.Status, types.Filled)
+	}
+	if resting.Status != types.Open || !resting.FilledQuantity.IsZero() {
+		t.Fatalf("caller's order changed to %s after it was placed", resting.Status)
+	}
+}
+
+func TestFillOrKillFollowsMatching(t *testing.T) {
+	tests := []struct {
+		name       string
+		stp        types.SelfTradePrevention
+		makers     func() []*models.Order
+		wantFilled bool
+	}{
+		{
+			name: "iceberg slice rejoins behind an own order",
+			stp:  types.STPCancelNewest,
+			makers: func() []*models.Order {
+				iceberg := newTestOrder("fok-maker", types.Sell, types.Limit, "100", "3")
+				iceberg.DisplayQuantity = decimal.RequireFromString("1")
+				return []*models.Order{iceberg, newTestOrder("fok-taker", types.Sell, types.Limit, "100", "1")}
+			},
+		},
+		{
+			name: "own order ahead is cancelled",
+			stp:  types.STPCancelOldest,
+			makers: func() []*models.Order {
+				return []*models.Order{
+					newTestOrder("fok-taker", types.Sell, types.Limit, "100", "1"),
+					newTestOrder("fok-maker", types.Sell, types.Limit, "100", "3"),
+				}
+			},
+			wantFilled: true,
+		},
+		{
+			name: "own order ahead decrements the order",
+			stp:  types.STPDecrementAndCancel,
+			makers: func() []*models.Order {
+				return []*models.Order{
+					newTestOrder("fok-taker", types.Sell, types.Limit, "100", "1"),
+					newTestOrder("fok-maker", types.Sell, types.Limit, "100", "2"),
+				}
+			},
+			wantFilled: true,
+		},
+		{
+			name: "own order ahead cancels the order",
+			stp:  types.STPCancelBoth,
+			makers: func() []*models.Order {
+				return []*models.Order{
+					newTestOrder("fok-taker", types.Sell, types.Limit, "100", "1"),
+					newTestOrder("fok-maker", types.Sell, types.Limit, "100", "3"),
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newTestEngine(t)
+			for _, maker := range tt.makers() {
+				engine.place(t, maker)
+			}
+
+			taker := newTestOrder("fok-taker", types.Buy, types.Limit, "100", "3")
+			taker.TimeInForce = types.FOK
+			taker.STPMode = tt.stp
+			err := engine.PlaceOrder(taker, engine.publisher)
+			if tt.wantFilled {
+				if err != nil || taker.Status != types.Filled {
+					t.Fatalf("status = %s, err = %v, want filled", taker.Status, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("fill-or-kill order was accepted, status %s", taker.Status)
+			}
+			if !taker.FilledQuantity.IsZero() || engine.publisher.count("trades") != 0 {
+				t.Fatalf("rejected fill-or-kill order traded %s", taker.FilledQuantity)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package matching
+
+import (
+	"errors"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/instrument"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/types"
+)
+
+// UpdateMarkPrice sets the mark price of a symbol, checks the stops that work on it and
+// revalues the open positions of the symbol.
+// Mark and index prices come from external feeds and are not journaled: replay does not
+// need them because triggers are journaled with their outcome.
+func (m *MatchingEngine) UpdateMarkPrice(symbol string, price decimal.Decimal, publisher message.Publisher) error {
+	return m.updatePrice(symbol, types.MarkPrice, price, publisher)
+}
+
+// UpdateIndexPrice sets the index price of a symbol and checks the stops that work on it.
+func (m *MatchingEngine) UpdateIndexPrice(symbol string, price decimal.Decimal, publisher message.Publisher) error {
+	return m.updatePrice(symbol, types.IndexPrice, price, publisher)
+}
+
+func (m *MatchingEngine) updatePrice(symbol string, working types.WorkingType, price decimal.Decimal, publisher message.Publisher) error {
+	if !price.IsPositive() {
+		return errors.New("price must be positive")
+	}
+	return m.submit(symbol, &command{kind: priceCommand, working: working, price: price, publisher: publisher})
+}
+
+// GetPrice returns the last, mark or index price of a symbol, zero when it is not known yet.
+func (m *MatchingEngine) GetPrice(symbol string, working types.WorkingType) (decimal.Decimal, error) {
+	price := decimal.Zero
+	err := m.submit(symbol, &command{kind: queryCommand, query: func(ob *OrderBook) {
+		price = ob.triggerPrice(working)
+	}})
+	return price, err
+}
+
+func (ob *OrderBook) setPrice(working types.WorkingType, price decimal.Decimal) {
+	switch working {
+	case types.MarkPrice:
+		ob.MarkPrice = price
+	case types.IndexPrice:
+		ob.IndexPrice = price
+	}
+	ob.checkStops = true
+}
+
+// triggerPrice returns the price series a stop order works on.
+func (ob *OrderBook) triggerPrice(working types.WorkingType) decimal.Decimal {
+	switch working {
+	case types.MarkPrice:
+		return ob.MarkPrice
+	case types.IndexPrice:
+		return ob.IndexPrice
+	}
+	return ob.LastPrice
+}
+
+// bandReference is the price limit orders are kept close to: the mark price, or the last
+// price until a mark price is known.
+func (ob *OrderBook) bandReference() decimal.Decimal {
+	if ob.MarkPrice.IsPositive() {
+		return ob.MarkPrice
+	}
+	return ob.LastPrice
+}
+
+func (m *MatchingEngine) checkPriceBand(ob *OrderBook, price decimal.Decimal) error {
+	inst, err := m.instruments.Get(ob.Symbol)
+	if err != nil {
+		return err
+	}
+	return instrument.CheckPriceBand(inst, price, ob.bandReference())
+}
+
+func validateWorkingType(order *models.Order) error {
+	switch order.WorkingType {
+	case "":
+		order.WorkingType = types.LastPrice
+	case types.LastPrice, types.MarkPrice, types.IndexPrice:
+	default:
+		return errors.New("unknown working type: " + string(order.WorkingType))
+	}
+	return nil
+}
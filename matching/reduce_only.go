@@ -0,0 +1,209 @@
+package matching
+
+import (
+	"errors"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/journal"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/position"
+	"github.com/xhcdpg/crypto-trade/types"
+	"sync"
+)
+
+// positionModeLocks keeps one lock per user. Placements hold it for reading while their orders
+// are submitted and a position mode switch holds it for writing across its open orders check and
+// the switch, so no order validated against the old mode can be placed in between.
+type positionModeLocks struct {
+	locks map[string]*sync.RWMutex
+	mutex sync.Mutex // guards locks
+}
+
+func newPositionModeLocks() *positionModeLocks {
+	return &positionModeLocks{locks: make(map[string]*sync.RWMutex)}
+}
+
+func (l *positionModeLocks) get(userID string) *sync.RWMutex {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lock, ok := l.locks[userID]
+	if !ok {
+		lock = &sync.RWMutex{}
+		l.locks[userID] = lock
+	}
+	return lock
+}
+
+// SetPositionMode switches the user between one-way and hedge mode. Open orders were validated
+// against the old mode, so the switch is refused while the user has any, as well as open positions.
+// The user's placements wait until the switch is done.
+func (m *MatchingEngine) SetPositionMode(user *models.User, mode types.PositionMode) error {
+	lock := m.positionModes.get(user.ID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	hasOrders := false
+	err := m.broadcast(command{kind: queryCommand, query: func(ob *OrderBook) {
+		hasOrders = hasOrders || len(ob.userOrders(user.ID)) > 0
+	}})
+	if err != nil {
+		return err
+	}
+	if hasOrders {
+		return errors.New("position mode cannot be changed with open orders")
+	}
+	return m.positionManager.SetPositionMode(user, mode)
+}
+
+// validatePositionSide resolves the position an order trades on from the user's position mode.
+// One-way orders trade on the net position, hedge mode orders must name the long or short leg.
+func validatePositionSide(user *models.User, order *models.Order) error {
+	if user.PositionMode != types.Hedge {
+		if order.PositionSide != "" && order.PositionSide != types.Both {
+			return errors.New("position side can only be set in hedge mode")
+		}
+		order.PositionSide = types.Both
+		return nil
+	}
+
+	if order.PositionSide != types.Long && order.PositionSide != types.Short {
+		return errors.New("hedge mode orders need a long or short position side")
+	}
+	if order.ReduceOnly {
+		return errors.New("reduce-only is implied by the position side in hedge mode")
+	}
+	return nil
+}
+
+// checkReduceOnly makes sure a reduce-only or close-position order can only shrink the
+// user's current position. Close-position orders take the size of the position and
+// reduce-only orders larger than the position are clipped to it. In hedge mode every order
+// closing its leg is reduce-only. Stops are checked again when they trigger, since the
+// position may have changed in the meantime.
+func (m *MatchingEngine) checkReduceOnly(order *models.Order) error {
+	if !closesPosition(order) {
+		return nil
+	}
+	if order.ClosePosition && order.PositionSide != types.Both && position.OpensPosition(order.PositionSide, order.Side) {
+		return errors.New("close-position order must be on the closing side of its position")
+	}
+
+	current := m.positionManager.GetPosition(order.UserID, order.Symbol, order.PositionSide)
+	if current == nil || !current.Quantity.IsPositive() {
+		return errors.New("no open position to reduce")
+	}
+	if order.Side == current.Side {
+		return errors.New("reduce-only order would increase the position")
+	}
+
+	if order.ClosePosition || order.Quantity.GreaterThan(current.Quantity) {
+		order.Quantity = current.Quantity
+	}
+	return nil
+}
+
+// closesPosition reports whether an order may only shrink its position.
+func closesPosition(order *models.Order) bool {
+	return order.ReduceOnly || order.ClosePosition ||
+		order.PositionSide != types.Both && order.PositionSide != "" && !position.OpensPosition(order.PositionSide, order.Side)
+}
+
+// clipClosing limits a closing order about to fill to the position it closes, since other
+// fills of the user may have shrunk the position after the order was placed. An order left
+// with nothing to close is cancelled. Clips depend on positions, which replay does not have,
+// so they are journaled and replay applies the clips the entry being replayed recorded.
+func (m *MatchingEngine) clipClosing(ob *OrderBook, order *models.Order, publisher message.Publisher) error {
+	if !closesPosition(order) {
+		return nil
+	}
+
+	var quantity decimal.Decimal
+	if ob.replaying {
+		key := clipKey(order.ID, order.FilledQuantity)
+		clip, ok := ob.replayClips[key]
+		if !ok {
+			return nil
+		}
+		delete(ob.replayClips, key)
+		quantity = clip
+	} else {
+		closable := decimal.Zero
+		current := m.positionManager.GetPosition(order.UserID, order.Symbol, order.PositionSide)
+		if current != nil && current.Side != order.Side {
+			closable = current.Quantity
+		}
+		if remainingQuantity(order).LessThanOrEqual(closable) {
+			return nil
+		}
+		quantity = order.FilledQuantity.Add(closable)
+		err := m.record(ob, &journal.Entry{Type: journal.Clip, OrderID: order.ID, Quantity: quantity, Filled: order.FilledQuantity})
+		if err != nil {
+			return err
+		}
+	}
+	return ob.clipOrder(order, quantity, publisher)
+}
+
+// clipOrder cuts the total quantity of an order down to quantity, cancelling it when nothing
+// is left to fill. Resting orders keep their queue priority.
+func (ob *OrderBook) clipOrder(order *models.Order, quantity decimal.Decimal, publisher message.Publisher) error {
+	if quantity.LessThanOrEqual(order.FilledQuantity) {
+		if ob.GetOrder(order.ID) != nil {
+			return removeAndCancel(ob, order, publisher)
+		}
+		return cancelTaker(order, publisher)
+	}
+	if node := ob.GetOrder(order.ID); node != nil {
+		ob.shrinkResting(node, quantity)
+	} else {
+		order.Quantity = quantity
+	}
+	return publishOrder("order_decremented", order, publisher)
+}
+
+func clipKey(orderID string, filled decimal.Decimal) string {
+	return orderID + "/" + filled.String()
+}
+
+// isFollowUp reports whether an entry records a decision taken while applying the command of the
+// entry before it, rather than a command of its own.
+func isFollowUp(entry *journal.Entry) bool {
+	return entry.Type == journal.Clip || entry.Type == journal.Activate
+}
+
+// pendingClips returns the clips journaled right after an entry, by the command of that entry.
+func pendingClips(entries []*journal.Entry) map[string]decimal.Decimal {
+	var clips map[string]decimal.Decimal
+	for _, entry := range entries {
+		if !isFollowUp(entry) {
+			break
+		}
+		if entry.Type != journal.Clip {
+			continue
+		}
+		if clips == nil {
+			clips = make(map[string]decimal.Decimal)
+		}
+		clips[clipKey(entry.OrderID, entry.Filled)] = entry.Quantity
+	}
+	return clips
+}
+
+// pendingActivations returns the quantities of the bracket legs activated right after an entry,
+// by the command of that entry.
+func pendingActivations(entries []*journal.Entry) map[string]decimal.Decimal {
+	var activations map[string]decimal.Decimal
+	for _, entry := range entries {
+		if !isFollowUp(entry) {
+			break
+		}
+		if entry.Type != journal.Activate {
+			continue
+		}
+		if activations == nil {
+			activations = make(map[string]decimal.Decimal)
+		}
+		activations[entry.OrderID] = entry.Quantity
+	}
+	return activations
+}
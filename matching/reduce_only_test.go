@@ -0,0 +1,112 @@
+package matching
+
+import (
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/types"
+	u "github.com/xhcdpg/crypto-trade/user"
+	"testing"
+	"time"
+)
+
+func setPositionMode(t *testing.T, engine *testEngine, userID string, mode types.PositionMode) error {
+	t.Helper()
+	user, err := u.GlobalUserService.GetUser(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine.SetPositionMode(user, mode)
+}
+
+func newHedgeOrder(userID string, side types.Side, positionSide types.PositionSide, price, quantity string) *models.Order {
+	order := newTestOrder(userID, side, types.Limit, price, quantity)
+	order.PositionSide = positionSide
+	return order
+}
+
+func TestHedgeKeepsLongAndShortApart(t *testing.T) {
+	engine := newTestEngine(t)
+	if err := setPositionMode(t, engine, "hedge-apart", types.Hedge); err != nil {
+		t.Fatal(err)
+	}
+
+	engine.place(t, newTestOrder("hedge-maker", types.Sell, types.Limit, "100", "2"))
+	engine.place(t, newHedgeOrder("hedge-apart", types.Buy, types.Long, "100", "2"))
+	engine.place(t, newTestOrder("hedge-maker", types.Buy, types.Limit, "100", "1"))
+	engine.place(t, newHedgeOrder("hedge-apart", types.Sell, types.Short, "100", "1"))
+
+	if got := engine.positionQuantity("hedge-apart", types.Long); got != "2" {
+		t.Fatalf("long position = %s, want 2", got)
+	}
+	if got := engine.positionQuantity("hedge-apart", types.Short); got != "1" {
+		t.Fatalf("short position = %s, want 1, opening a short must not net the long", got)
+	}
+}
+
+func TestHedgeCloseCannotOverfillItsLeg(t *testing.T) {
+	engine := newTestEngine(t)
+	if err := setPositionMode(t, engine, "hedge-overfill", types.Hedge); err != nil {
+		t.Fatal(err)
+	}
+	engine.place(t, newTestOrder("hedge-maker", types.Sell, types.Limit, "100", "1"))
+	engine.place(t, newHedgeOrder("hedge-overfill", types.Buy, types.Long, "100", "1"))
+
+	engine.place(t, newTestOrder("hedge-maker", types.Buy, types.Limit, "100", "5"))
+	closing := newHedgeOrder("hedge-overfill", types.Sell, types.Long, "100", "3")
+	engine.place(t, closing)
+	if closing.Status != types.Filled || closing.FilledQuantity.String() != "1" {
+		t.Fatalf("closing order %s filled %s, want filled at the long's size 1", closing.Status, closing.FilledQuantity)
+	}
+	if got := engine.positionQuantity("hedge-overfill", types.Long); got != "0" {
+		t.Fatalf("long position = %s, want 0", got)
+	}
+	if got := engine.positionQuantity("hedge-overfill", types.Short); got != "0" {
+		t.Fatalf("short position = %s, closing the long must not open a short", got)
+	}
+
+	if err := engine.PlaceOrder(newHedgeOrder("hedge-overfill", types.Sell, types.Long, "100", "1"), engine.publisher); err == nil {
+		t.Fatal("closing order without a long position was accepted")
+	}
+}
+
+func TestPositionModeCannotChangeWithOpenOrders(t *testing.T) {
+	engine := newTestEngine(t)
+	resting := newTestOrder("mode-orders", types.Buy, types.Limit, "50", "1")
+	engine.place(t, resting)
+
+	if err := setPositionMode(t, engine, "mode-orders", types.Hedge); err == nil {
+		t.Fatal("position mode changed with an open order")
+	}
+	if err := engine.CancelOrder(testSymbol, resting.ID, "mode-orders", engine.publisher); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPositionMode(t, engine, "mode-orders", types.Hedge); err != nil {
+		t.Fatalf("position mode change without open orders: %v", err)
+	}
+}
+
+// A switch waits for placements of the user that are still being submitted, which were
+// validated against the old mode and may end up resting.
+func TestPositionModeSwitchWaitsForPlacements(t *testing.T) {
+	engine := newTestEngine(t)
+	lock := engine.positionModes.get("mode-wait")
+	lock.RLock()
+
+	switched := make(chan error, 1)
+	go func() {
+		user, err := u.GlobalUserService.GetUser("mode-wait")
+		if err == nil {
+			err = engine.SetPositionMode(user, types.Hedge)
+		}
+		switched <- err
+	}()
+	select {
+	case err := <-switched:
+		t.Fatalf("switch did not wait for the placement in flight, err = %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	lock.RUnlock()
+	if err := <-switched; err != nil {
+		t.Fatalf("switch after the placement: %v", err)
+	}
+}
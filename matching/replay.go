@@ -0,0 +1,194 @@
+package matching
+
+import (
+	"fmt"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/xhcdpg/crypto-trade/journal"
+	"github.com/xhcdpg/crypto-trade/snapshot"
+	"github.com/xhcdpg/crypto-trade/types"
+	"strconv"
+)
+
+// record assigns the next sequence number of the book to an accepted command and appends it
+// to the journal before the command is applied. It is a no-op while the book is replaying.
+func (m *MatchingEngine) record(ob *OrderBook, entry *journal.Entry) error {
+	if ob.replaying {
+		return nil
+	}
+
+	entry.Symbol = ob.Symbol
+	entry.Sequence = ob.Sequence + 1
+	if m.journal != nil {
+		if err := m.journal.Append(entry); err != nil {
+			return err
+		}
+	}
+	ob.Sequence = entry.Sequence
+	return nil
+}
+
+// Recover rebuilds the book of every registered instrument from its latest snapshot and the
+// journal entries recorded after it. It must run before the engine accepts any order.
+func (m *MatchingEngine) Recover() error {
+	for _, inst := range m.instruments.List() {
+		var (
+			snap    *snapshot.Snapshot
+			entries []*journal.Entry
+			err     error
+		)
+		if m.snapshots != nil {
+			if snap, err = m.snapshots.Latest(inst.Symbol); err != nil {
+				return err
+			}
+		}
+		if m.journal != nil {
+			afterSequence := uint64(0)
+			if snap != nil {
+				afterSequence = snap.Sequence
+			}
+			if entries, err = m.journal.Read(inst.Symbol, afterSequence); err != nil {
+				return err
+			}
+		}
+		if snap == nil && len(entries) == 0 {
+			continue
+		}
+
+		if err := m.submit(inst.Symbol, &command{kind: recoverCommand, snapshot: snap, entries: entries}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MatchingEngine) recoverBook(ob *OrderBook, snap *snapshot.Snapshot, entries []*journal.Entry) error {
+	if snap != nil {
+		if err := restoreSnapshot(ob, snap); err != nil {
+			return err
+		}
+		if snap.Status != "" {
+			if err := m.instruments.SetStatus(ob.Symbol, snap.Status); err != nil {
+				return err
+			}
+		}
+	}
+	return m.replay(ob, entries)
+}
+
+// replay applies journal entries to the book without validating, publishing or touching positions.
+// Errors returned by individual commands are expected, they reproduce what happened the first time.
+// Messages are only counted, so the topic sequences continue where they were.
+func (m *MatchingEngine) replay(ob *OrderBook, entries []*journal.Entry) error {
+	ob.replaying = true
+	defer func() { ob.replaying = false }()
+
+	publisher := &sequencedPublisher{publisher: discardPublisher{}, book: ob}
+	for i, entry := range entries {
+		if entry.Sequence != ob.Sequence+1 {
+			return fmt.Errorf("journal gap on %s: expected sequence %d, got %d", ob.Symbol, ob.Sequence+1, entry.Sequence)
+		}
+		ob.Sequence = entry.Sequence
+		if !isFollowUp(entry) {
+			ob.replayClips = pendingClips(entries[i+1:])
+			ob.replayActivations = pendingActivations(entries[i+1:])
+		}
+
+		switch entry.Type {
+		case journal.Place:
+			m.applyOrder(ob, entry.Order, publisher)
+		case journal.PlaceGroup:
+			m.applyGroup(ob, entry.Orders, publisher)
+		case journal.Cancel:
+			m.cancelOrder(ob, entry.OrderID, entry.UserID, publisher)
+		case journal.CancelAll:
+			m.cancelAllOrders(ob, entry.UserID, publisher)
+		case journal.Amend:
+			m.amendOrder(ob, &command{
+				orderID:   entry.OrderID,
+				userID:    entry.UserID,
+				price:     entry.Price,
+				stopPrice: entry.StopPrice,
+				quantity:  entry.Quantity,
+				time:      entry.Time,
+			}, publisher)
+		case journal.Trigger:
+			stop := ob.Stops.Remove(entry.OrderID)
+			if entry.Order != nil {
+				if stop != nil {
+					stop.Status = types.Triggered
+				}
+				m.applyOrder(ob, entry.Order, publisher)
+			} else if stop != nil {
+				rejectOrder(stop, nil, publisher)
+			}
+		case journal.Trail:
+			if stop := ob.Stops.Get(entry.OrderID); stop != nil {
+				stop.Watermark = entry.Price
+				stop.StopPrice = entry.StopPrice
+			}
+		case journal.Expire:
+			m.expireOrders(ob, entry.Time, publisher)
+		case journal.Auction:
+			ob.auction = true
+		case journal.Uncross:
+			m.uncross(ob, publisher)
+		case journal.State:
+			inst, err := m.instruments.Get(ob.Symbol)
+			if err != nil {
+				return err
+			}
+			if err := m.instruments.SetStatus(ob.Symbol, entry.Status); err != nil {
+				return err
+			}
+			ob.breaker = circuitBreaker{trippedAt: entry.Time}
+			publishTradingState(ob.Symbol, inst.Status, entry.Status, "", publisher)
+		case journal.Activate:
+			// applied while replaying the entry whose command activated the bracket
+		case journal.Clip:
+			// normally applied already while replaying the entry that recorded it
+			if node := ob.GetOrder(entry.OrderID); node != nil && node.Order.Quantity.GreaterThan(entry.Quantity) {
+				ob.clipOrder(node.Order, entry.Quantity, publisher)
+			}
+		default:
+			return fmt.Errorf("unknown journal entry type %q at %s#%d", entry.Type, ob.Symbol, entry.Sequence)
+		}
+		m.resolveGroups(ob, publisher)
+		m.publishIndicative(ob, publisher)
+	}
+	ob.replayClips = nil
+	ob.replayActivations = nil
+	return nil
+}
+
+// sequencedPublisher stamps every message with the symbol, the sequence number of the command
+// that produced it and its own number among the messages of the symbol on its topic. The topic
+// sequence has no holes, so consumers can detect gaps. Replay publishes through it too, which
+// keeps the numbers counting from where they were before a restart.
+type sequencedPublisher struct {
+	publisher message.Publisher
+	book      *OrderBook
+}
+
+func (p *sequencedPublisher) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		p.book.messages[topic]++
+		msg.Metadata.Set("symbol", p.book.Symbol)
+		msg.Metadata.Set("sequence", strconv.FormatUint(p.book.Sequence, 10))
+		msg.Metadata.Set("topic_sequence", strconv.FormatUint(p.book.messages[topic], 10))
+	}
+	return p.publisher.Publish(topic, messages...)
+}
+
+func (p *sequencedPublisher) Close() error {
+	return p.publisher.Close()
+}
+
+type discardPublisher struct{}
+
+func (discardPublisher) Publish(topic string, messages ...*message.Message) error {
+	return nil
+}
+
+func (discardPublisher) Close() error {
+	return nil
+}
@@ -0,0 +1,32 @@
+package matching
+
+import (
+	"github.com/xhcdpg/crypto-trade/types"
+	"strconv"
+	"testing"
+)
+
+func TestTopicSequenceSurvivesRestart(t *testing.T) {
+	engine := newTestEngine(t)
+	engine.place(t, newTestOrder("maker", types.Sell, types.Limit, "100", "1"))
+	engine.place(t, newTestOrder("taker", types.Buy, types.Limit, "100", "0.5"))
+	if err := engine.TakeSnapshots(); err != nil {
+		t.Fatal(err)
+	}
+	// replayed from the journal on top of the snapshot
+	engine.place(t, newTestOrder("taker", types.Buy, types.Limit, "90", "1"))
+	engine.restart(t)
+	engine.place(t, newTestOrder("taker", types.Buy, types.Limit, "100", "0.5"))
+
+	for _, topic := range []string{"orders", "trades"} {
+		sequences := engine.publisher.metadata(topic, "topic_sequence")
+		for i, sequence := range sequences {
+			if sequence != strconv.Itoa(i+1) {
+				t.Fatalf("%s topic sequences = %v, want 1 to %d", topic, sequences, len(sequences))
+			}
+		}
+	}
+	if got := engine.publisher.count("trades"); got != 2 {
+		t.Fatalf("%d trades published, want 2", got)
+	}
+}
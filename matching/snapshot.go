@@ -0,0 +1,177 @@
+package matching
+
+import (
+	"context"
+	"errors"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/snapshot"
+	"github.com/xhcdpg/crypto-trade/types"
+	"log"
+	"time"
+)
+
+// RunSnapshots snapshots every book each interval until ctx is done.
+func (m *MatchingEngine) RunSnapshots(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.TakeSnapshots(); err != nil {
+				log.Println("failed to snapshot order books", err)
+			}
+		}
+	}
+}
+
+// TakeSnapshots saves the state of every book and truncates the journal entries the snapshots cover.
+func (m *MatchingEngine) TakeSnapshots() error {
+	if m.snapshots == nil {
+		return nil
+	}
+
+	for _, w := range m.getWorkers() {
+		var (
+			snap     *snapshot.Snapshot
+			buildErr error
+		)
+		err := m.send(w, &command{kind: queryCommand, query: func(ob *OrderBook) {
+			inst, err := m.instruments.Get(ob.Symbol)
+			if err != nil {
+				buildErr = err
+				return
+			}
+			snap, buildErr = buildSnapshot(ob, inst.Status)
+		}})
+		if errors.Is(err, errBookHalted) {
+			// a halted book may be half updated, it is rebuilt from the journal instead
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if buildErr != nil {
+			return buildErr
+		}
+
+		if err := m.snapshots.Save(snap); err != nil {
+			return err
+		}
+		if m.journal != nil {
+			if err := m.journal.Truncate(snap.Symbol, snap.Sequence); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// buildSnapshot copies the book and the trading state of its symbol so the snapshot can be
+// saved outside the worker goroutine.
+func buildSnapshot(ob *OrderBook, status types.InstrumentStatus) (*snapshot.Snapshot, error) {
+	snap := &snapshot.Snapshot{
+		Symbol:    ob.Symbol,
+		Sequence:  ob.Sequence,
+		Bids:      copyNodeOrders(ob.Bids.Orders()),
+		Asks:      copyNodeOrders(ob.Asks.Orders()),
+		Stops:     make([]*models.Order, 0, ob.Stops.Len()),
+		LastPrice: ob.LastPrice,
+		Legs:      copyOrders(ob.pendingLegs()),
+		Visible:   ob.icebergVisible(),
+		Auction:   ob.auction,
+		Status:    status,
+		Messages:  make(map[string]uint64, len(ob.messages)),
+		Closed:    ob.clientOrders.closed(),
+		CreatedAt: time.Now(),
+	}
+	for topic, count := range ob.messages {
+		snap.Messages[topic] = count
+	}
+	if !ob.breaker.trippedAt.IsZero() {
+		trippedAt := ob.breaker.trippedAt
+		snap.TrippedAt = &trippedAt
+	}
+	for _, order := range ob.Stops.Orders() {
+		o := *order
+		snap.Stops = append(snap.Stops, &o)
+	}
+
+	checksum, err := snap.ComputeChecksum()
+	if err != nil {
+		return nil, err
+	}
+	snap.Checksum = checksum
+	return snap, nil
+}
+
+func copyOrders(orders []*models.Order) []*models.Order {
+	if len(orders) == 0 {
+		return nil
+	}
+	copies := make([]*models.Order, 0, len(orders))
+	for _, order := range orders {
+		o := *order
+		copies = append(copies, &o)
+	}
+	return copies
+}
+
+func copyNodeOrders(nodes []*OrderNode) []*models.Order {
+	orders := make([]*models.Order, 0, len(nodes))
+	for _, node := range nodes {
+		o := *node.Order
+		orders = append(orders, &o)
+	}
+	return orders
+}
+
+// restoreSnapshot loads a verified snapshot into an empty book and checks that the
+// rebuilt book hashes to the same checksum.
+func restoreSnapshot(ob *OrderBook, snap *snapshot.Snapshot) error {
+	if err := snap.Verify(); err != nil {
+		return err
+	}
+
+	for _, order := range snap.Bids {
+		ob.restOrder(order)
+	}
+	for _, order := range snap.Asks {
+		ob.restOrder(order)
+	}
+	for _, order := range snap.Stops {
+		ob.Stops.Add(order)
+	}
+	for orderID, visible := range snap.Visible {
+		if node := ob.GetOrder(orderID); node != nil {
+			ob.side(node.Order.Side).Reduce(node, node.Quantity.Sub(visible))
+		}
+	}
+	orders := append(append(append([]*models.Order(nil), snap.Bids...), snap.Asks...), snap.Stops...)
+	ob.restoreGroups(orders, snap.Legs)
+	// closed orders first, so retried submissions are still recognized after the journal is truncated
+	for _, order := range snap.Closed {
+		ob.clientOrders.add(order)
+	}
+	for _, order := range append(orders, snap.Legs...) {
+		ob.clientOrders.add(order)
+	}
+	ob.LastPrice = snap.LastPrice
+	ob.auction = snap.Auction
+	if snap.TrippedAt != nil {
+		ob.breaker.trippedAt = *snap.TrippedAt
+	}
+	ob.Sequence = snap.Sequence
+	for topic, count := range snap.Messages {
+		ob.messages[topic] = count
+	}
+
+	restored, err := buildSnapshot(ob, snap.Status)
+	if err != nil {
+		return err
+	}
+	restored.CreatedAt = snap.CreatedAt
+	restored.Checksum = snap.Checksum
+	return restored.Verify()
+}
@@ -0,0 +1,207 @@
+package matching
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/instrument"
+	"github.com/xhcdpg/crypto-trade/journal"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/types"
+	"log"
+	"time"
+)
+
+// SetTradingState moves a symbol to a new trading state and broadcasts the change on
+// "trading_state_changed". The change runs on the book's worker, so commands queued
+// before it are still handled in the old state.
+func (m *MatchingEngine) SetTradingState(symbol string, status types.InstrumentStatus, reason string, publisher message.Publisher) error {
+	switch status {
+	case types.Trading, types.CancelOnly, types.Halted, types.Auction, types.Delisted:
+	default:
+		return errors.New("unknown trading state: " + string(status))
+	}
+	return m.submit(symbol, &command{kind: stateCommand, status: status, reason: reason, publisher: publisher})
+}
+
+func (m *MatchingEngine) Halt(symbol, reason string, publisher message.Publisher) error {
+	return m.SetTradingState(symbol, types.Halted, reason, publisher)
+}
+
+func (m *MatchingEngine) Resume(symbol, reason string, publisher message.Publisher) error {
+	return m.SetTradingState(symbol, types.Trading, reason, publisher)
+}
+
+// setTradingState moves the book to status. trippedAt is when the circuit breaker halted the
+// book and is zero for any other change; it is journaled so the cooldown survives a restart.
+func (m *MatchingEngine) setTradingState(ob *OrderBook, status types.InstrumentStatus, reason string, trippedAt time.Time, publisher message.Publisher) error {
+	inst, err := m.instruments.Get(ob.Symbol)
+	if err != nil {
+		return err
+	}
+	if inst.Status == status {
+		return nil
+	}
+
+	ob.breaker = circuitBreaker{trippedAt: trippedAt}
+	switch status {
+	case types.Auction:
+		err = m.startAuction(ob)
+	case types.Trading:
+		// orders collected by an auction are uncrossed before continuous matching resumes
+		err = m.endAuction(ob, publisher)
+	}
+	if err != nil {
+		return err
+	}
+	// journaled so a restart comes back in the same state
+	if err := m.record(ob, &journal.Entry{Type: journal.State, Status: status, Time: trippedAt}); err != nil {
+		return err
+	}
+	if err := m.instruments.SetStatus(ob.Symbol, status); err != nil {
+		return err
+	}
+
+	if status == types.Trading {
+		// stops wait while the book is not trading
+		ob.checkStops = true
+	}
+
+	return publishTradingState(ob.Symbol, inst.Status, status, reason, publisher)
+}
+
+func publishTradingState(symbol string, from, to types.InstrumentStatus, reason string, publisher message.Publisher) error {
+	if publisher == nil {
+		return nil
+	}
+	changeJson, err := json.Marshal(&models.TradingStateChange{
+		Symbol:    symbol,
+		From:      from,
+		To:        to,
+		Reason:    reason,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	return publisher.Publish("trading_state_changed", message.NewMessage(uuid.New().String(), changeJson))
+}
+
+// isTrading reports whether orders of the book may be matched and stops triggered.
+func (m *MatchingEngine) isTrading(ob *OrderBook) bool {
+	inst, err := m.instruments.Get(ob.Symbol)
+	return err == nil && inst.Status == types.Trading
+}
+
+// checkCanCancel is skipped on replay: the state was checked when the command was accepted.
+func (m *MatchingEngine) checkCanCancel(ob *OrderBook) error {
+	if ob.replaying {
+		return nil
+	}
+	inst, err := m.instruments.Get(ob.Symbol)
+	if err != nil {
+		return err
+	}
+	if !instrument.CanCancel(inst.Status) {
+		return errors.New("orders cannot be cancelled while symbol is " + string(inst.Status))
+	}
+	return nil
+}
+
+func (m *MatchingEngine) checkCanAmend(ob *OrderBook) error {
+	if ob.replaying || ob.auction || m.isTrading(ob) {
+		return nil
+	}
+	return errors.New("orders cannot be amended while symbol is not trading")
+}
+
+type pricePoint struct {
+	price decimal.Decimal
+	time  time.Time
+}
+
+// circuitBreaker keeps the trade prices of the instrument's circuit breaker window.
+type circuitBreaker struct {
+	prices    []pricePoint
+	trippedAt time.Time // set while the book is halted by the breaker
+}
+
+func (b *circuitBreaker) record(price decimal.Decimal, now time.Time) {
+	b.prices = append(b.prices, pricePoint{price: price, time: now})
+}
+
+// move returns how far the price moved within the points kept, relative to the lowest price.
+func (b *circuitBreaker) move(since time.Time) decimal.Decimal {
+	i := 0
+	for i < len(b.prices) && b.prices[i].time.Before(since) {
+		i++
+	}
+	b.prices = b.prices[i:]
+	if len(b.prices) == 0 {
+		return decimal.Zero
+	}
+
+	low, high := b.prices[0].price, b.prices[0].price
+	for _, point := range b.prices[1:] {
+		low = decimal.Min(low, point.price)
+		high = decimal.Max(high, point.price)
+	}
+	return high.Sub(low).Div(low)
+}
+
+// checkCircuitBreaker halts the book when the price moved more than the instrument allows
+// within its window.
+func (m *MatchingEngine) checkCircuitBreaker(ob *OrderBook, publisher message.Publisher) {
+	inst, err := m.instruments.Get(ob.Symbol)
+	if err != nil || !inst.CircuitBreakerPercent.IsPositive() || inst.Status != types.Trading {
+		ob.breaker.prices = nil
+		return
+	}
+
+	now := time.Now()
+	window := time.Duration(inst.CircuitBreakerWindow) * time.Second
+	if ob.breaker.move(now.Add(-window)).LessThanOrEqual(inst.CircuitBreakerPercent) {
+		return
+	}
+
+	reason := fmt.Sprintf("circuit breaker: price moved more than %s within %s", inst.CircuitBreakerPercent, window)
+	if err := m.setTradingState(ob, types.Halted, reason, now, publisher); err != nil {
+		log.Println("failed to halt", ob.Symbol, err)
+	}
+}
+
+// RunCircuitBreakers resumes trading on books halted by their circuit breaker once the
+// instrument's cooldown has elapsed, checking every interval until ctx is done.
+func (m *MatchingEngine) RunCircuitBreakers(ctx context.Context, interval time.Duration, publisher message.Publisher) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := m.broadcast(command{kind: breakerCommand, time: now, publisher: publisher}); err != nil {
+				log.Println("failed to check circuit breakers", err)
+			}
+		}
+	}
+}
+
+func (m *MatchingEngine) resumeAfterCooldown(ob *OrderBook, now time.Time, publisher message.Publisher) error {
+	if ob.breaker.trippedAt.IsZero() {
+		return nil
+	}
+	inst, err := m.instruments.Get(ob.Symbol)
+	if err != nil {
+		return err
+	}
+	cooldown := time.Duration(inst.CircuitBreakerCooldown) * time.Second
+	if inst.Status != types.Halted || cooldown == 0 || now.Before(ob.breaker.trippedAt.Add(cooldown)) {
+		return nil
+	}
+	return m.setTradingState(ob, types.Trading, "circuit breaker cooldown elapsed", time.Time{}, publisher)
+}
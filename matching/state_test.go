@@ -0,0 +1,66 @@
+package matching
+
+import (
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/types"
+	"testing"
+	"time"
+)
+
+func TestBreakerCooldownSurvivesRestart(t *testing.T) {
+	engine := newTestEngine(t)
+	err := engine.instruments.Register(&models.Instrument{
+		Symbol:                 otherSymbol,
+		TickSize:               decimal.RequireFromString("0.1"),
+		LotSize:                decimal.RequireFromString("0.001"),
+		MinQuantity:            decimal.RequireFromString("0.001"),
+		MaxLeverage:            100,
+		CircuitBreakerPercent:  decimal.RequireFromString("0.05"),
+		CircuitBreakerWindow:   60,
+		CircuitBreakerCooldown: 60,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	place := func(userID string, side types.Side, price, quantity string) {
+		order := newTestOrder(userID, side, types.Limit, price, quantity)
+		order.Symbol = otherSymbol
+		engine.place(t, order)
+	}
+	status := func() types.InstrumentStatus {
+		inst, err := engine.instruments.Get(otherSymbol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inst.Status
+	}
+	place("maker", types.Sell, "100", "1")
+	place("maker", types.Sell, "110", "1")
+	place("taker", types.Buy, "110", "1.5")
+	if status() != types.Halted {
+		t.Fatalf("status after a 10%% move = %s, want %s", status(), types.Halted)
+	}
+
+	resume := func(now time.Time) {
+		t.Helper()
+		if err := engine.submit(otherSymbol, &command{kind: breakerCommand, time: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// from the journal, then from a snapshot
+	engine.restart(t)
+	resume(time.Now())
+	if err := engine.TakeSnapshots(); err != nil {
+		t.Fatal(err)
+	}
+	engine.restart(t)
+	resume(time.Now())
+	if status() != types.Halted {
+		t.Fatalf("status before the cooldown elapsed = %s, want %s", status(), types.Halted)
+	}
+	resume(time.Now().Add(time.Minute))
+	if status() != types.Trading {
+		t.Fatalf("status after the cooldown = %s, want %s", status(), types.Trading)
+	}
+}
@@ -0,0 +1,165 @@
+package matching
+
+import (
+	"container/list"
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/types"
+)
+
+// workingTypes is the order in which price series are checked for triggered stops.
+var workingTypes = []types.WorkingType{types.LastPrice, types.MarkPrice, types.IndexPrice}
+
+// StopQueue holds the pending stop orders of a book. Fixed-price stops are indexed per
+// working type by stop price, in one index for stops that fire when the price rises to
+// their stop price and one for stops that fire when it falls to it, so finding the next
+// triggered stop only looks at the front of each index. Trailing stops move with the
+// price and are kept in a plain list per working type.
+type StopQueue struct {
+	orders   *list.List // insertion order, for snapshots
+	index    map[string]*stopEntry
+	triggers map[types.WorkingType]*triggerIndex
+}
+
+type stopEntry struct {
+	order   *models.Order
+	element *list.Element
+	node    *OrderNode    // position in the rising or falling index
+	trailed *list.Element // position in the trailing list
+}
+
+type triggerIndex struct {
+	rising   *BookSide  // lowest stop price first
+	falling  *BookSide  // highest stop price first
+	trailing *list.List // of *models.Order
+}
+
+func NewStopQueue() *StopQueue {
+	sq := &StopQueue{
+		orders:   list.New(),
+		index:    make(map[string]*stopEntry),
+		triggers: make(map[types.WorkingType]*triggerIndex),
+	}
+	for _, working := range workingTypes {
+		sq.triggers[working] = &triggerIndex{
+			rising:   NewBookSide(false),
+			falling:  NewBookSide(true),
+			trailing: list.New(),
+		}
+	}
+	return sq
+}
+
+func (sq *StopQueue) Add(order *models.Order) {
+	entry := &stopEntry{order: order}
+	entry.element = sq.orders.PushBack(order)
+	sq.index[order.ID] = entry
+
+	triggers := sq.getTriggers(order.WorkingType)
+	if order.Type == types.TrailingStop {
+		entry.trailed = triggers.trailing.PushBack(order)
+		return
+	}
+	entry.node = &OrderNode{
+		Price:     order.StopPrice,
+		Quantity:  order.Quantity,
+		OrderID:   order.ID,
+		UserID:    order.UserID,
+		Timestamp: order.Timestamp,
+		Order:     order,
+	}
+	if isRisingTrigger(order) {
+		triggers.rising.Add(entry.node)
+	} else {
+		triggers.falling.Add(entry.node)
+	}
+}
+
+func (sq *StopQueue) Get(orderID string) *models.Order {
+	if entry, ok := sq.index[orderID]; ok {
+		return entry.order
+	}
+	return nil
+}
+
+func (sq *StopQueue) Remove(orderID string) *models.Order {
+	entry, ok := sq.index[orderID]
+	if !ok {
+		return nil
+	}
+	delete(sq.index, orderID)
+	sq.orders.Remove(entry.element)
+
+	triggers := sq.getTriggers(entry.order.WorkingType)
+	if entry.trailed != nil {
+		triggers.trailing.Remove(entry.trailed)
+	} else if isRisingTrigger(entry.order) {
+		triggers.rising.Remove(entry.node)
+	} else {
+		triggers.falling.Remove(entry.node)
+	}
+	return entry.order
+}
+
+// Orders returns the pending stops in the order they were added.
+func (sq *StopQueue) Orders() []*models.Order {
+	orders := make([]*models.Order, 0, sq.orders.Len())
+	for e := sq.orders.Front(); e != nil; e = e.Next() {
+		orders = append(orders, e.Value.(*models.Order))
+	}
+	return orders
+}
+
+func (sq *StopQueue) Len() int { return sq.orders.Len() }
+
+// trailing returns the trailing stops working on the given price series.
+func (sq *StopQueue) trailing(working types.WorkingType) []*models.Order {
+	var orders []*models.Order
+	for e := sq.getTriggers(working).trailing.Front(); e != nil; e = e.Next() {
+		orders = append(orders, e.Value.(*models.Order))
+	}
+	return orders
+}
+
+// next returns the stop that fires first at the given prices, or nil. Price series are
+// checked in workingTypes order; within one series rising stops come before falling ones,
+// then trailing stops, and stops with the same stop price fire in the order they were added.
+// A series without a price yet never triggers.
+func (sq *StopQueue) next(price func(types.WorkingType) decimal.Decimal) *models.Order {
+	for _, working := range workingTypes {
+		current := price(working)
+		if current.IsZero() {
+			continue
+		}
+		triggers := sq.triggers[working]
+		if node := triggers.rising.Front(); node != nil && current.GreaterThanOrEqual(node.Price) {
+			return node.Order
+		}
+		if node := triggers.falling.Front(); node != nil && current.LessThanOrEqual(node.Price) {
+			return node.Order
+		}
+		for e := triggers.trailing.Front(); e != nil; e = e.Next() {
+			if order := e.Value.(*models.Order); shouldTriggerStop(order, current) {
+				return order
+			}
+		}
+	}
+	return nil
+}
+
+func (sq *StopQueue) getTriggers(working types.WorkingType) *triggerIndex {
+	if triggers, ok := sq.triggers[working]; ok {
+		return triggers
+	}
+	return sq.triggers[types.LastPrice]
+}
+
+// isRisingTrigger reports whether the stop fires when the price rises to its stop price:
+// buy stop-losses and sell take-profits. The others fire when the price falls to it.
+func isRisingTrigger(order *models.Order) bool {
+	switch order.Type {
+	case types.LimitStopLoss, types.MarketStopLoss, types.TrailingStop:
+		return order.Side == types.Buy
+	}
+	return order.Side == types.Sell
+}
@@ -0,0 +1,80 @@
+package matching
+
+import (
+	"errors"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/types"
+)
+
+func validateSelfTradePrevention(order *models.Order) error {
+	switch order.STPMode {
+	case types.STPNone, types.STPCancelNewest, types.STPCancelOldest, types.STPCancelBoth, types.STPDecrementAndCancel:
+		return nil
+	}
+	return errors.New("unknown self-trade prevention mode: " + string(order.STPMode))
+}
+
+// isSelfTrade reports whether the taker must not trade with the maker under its STP mode.
+func isSelfTrade(taker *models.Order, maker *OrderNode) bool {
+	if taker.STPMode == types.STPNone {
+		return false
+	}
+	if taker.UserID == maker.UserID {
+		return true
+	}
+	return taker.STPGroupID != "" && taker.STPGroupID == maker.Order.STPGroupID
+}
+
+// preventSelfTrade applies the taker's STP mode instead of trading with the maker.
+// Cancelled orders are reported on "order_cancelled", orders that were only reduced
+// on "order_decremented".
+func preventSelfTrade(ob *OrderBook, taker *models.Order, maker *OrderNode, publisher message.Publisher) error {
+	switch taker.STPMode {
+	case types.STPCancelNewest:
+		return cancelTaker(taker, publisher)
+	case types.STPCancelOldest:
+		return removeAndCancel(ob, maker.Order, publisher)
+	case types.STPCancelBoth:
+		if err := removeAndCancel(ob, maker.Order, publisher); err != nil {
+			return err
+		}
+		return cancelTaker(taker, publisher)
+	case types.STPDecrementAndCancel:
+		return decrementBoth(ob, taker, maker, publisher)
+	}
+	return nil
+}
+
+// decrementBoth reduces both orders by the quantity they would have traded, cancelling
+// whichever runs out.
+func decrementBoth(ob *OrderBook, taker *models.Order, maker *OrderNode, publisher message.Publisher) error {
+	quantity := decimal.Min(remainingQuantity(taker), remainingQuantity(maker.Order))
+
+	if remainingQuantity(maker.Order).Equal(quantity) {
+		if err := removeAndCancel(ob, maker.Order, publisher); err != nil {
+			return err
+		}
+	} else {
+		ob.side(maker.Order.Side).Reduce(maker, decimal.Min(quantity, maker.Quantity))
+		maker.Order.Quantity = maker.Order.Quantity.Sub(quantity)
+		if maker.Quantity.IsZero() {
+			ob.replenish(maker)
+		}
+		if err := publishOrder("order_decremented", maker.Order, publisher); err != nil {
+			return err
+		}
+	}
+
+	taker.Quantity = taker.Quantity.Sub(quantity)
+	if !remainingQuantity(taker).IsPositive() {
+		return cancelTaker(taker, publisher)
+	}
+	return publishOrder("order_decremented", taker, publisher)
+}
+
+func cancelTaker(taker *models.Order, publisher message.Publisher) error {
+	taker.Status = types.Cancelled
+	return publishOrder("order_cancelled", taker, publisher)
+}
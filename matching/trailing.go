@@ -0,0 +1,74 @@
+package matching
+
+import (
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/journal"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/types"
+	"log"
+)
+
+// trailStops moves the trailing stops of every price series with its current price.
+func (m *MatchingEngine) trailStops(ob *OrderBook) {
+	for _, working := range workingTypes {
+		price := ob.triggerPrice(working)
+		if price.IsZero() {
+			continue
+		}
+		for _, order := range ob.Stops.trailing(working) {
+			if err := m.trailStop(ob, order, price); err != nil {
+				log.Println("failed to trail stop", order.ID, err)
+			}
+		}
+	}
+}
+
+// trailStop moves the watermark of a trailing stop with the price and recomputes its
+// stop price. Each move is journaled so replay restores the same trigger level.
+func (m *MatchingEngine) trailStop(ob *OrderBook, order *models.Order, price decimal.Decimal) error {
+	if price.IsZero() || !updateWatermark(order, price) {
+		return nil
+	}
+	order.StopPrice = trailingStopPrice(order)
+	return m.record(ob, &journal.Entry{
+		Type:      journal.Trail,
+		OrderID:   order.ID,
+		Price:     order.Watermark,
+		StopPrice: order.StopPrice,
+	})
+}
+
+// updateWatermark activates the order once the price reaches its activation price and then
+// tracks the highest price for sells or the lowest price for buys. It reports whether the
+// watermark changed.
+func updateWatermark(order *models.Order, price decimal.Decimal) bool {
+	if order.Watermark.IsZero() {
+		if !order.ActivationPrice.IsZero() {
+			if order.Side == types.Sell && price.LessThan(order.ActivationPrice) ||
+				order.Side == types.Buy && price.GreaterThan(order.ActivationPrice) {
+				return false
+			}
+		}
+		order.Watermark = price
+		return true
+	}
+
+	if order.Side == types.Sell && price.GreaterThan(order.Watermark) ||
+		order.Side == types.Buy && price.LessThan(order.Watermark) {
+		order.Watermark = price
+		return true
+	}
+	return false
+}
+
+// trailingStopPrice is the watermark minus the callback distance for sells, plus it for buys.
+func trailingStopPrice(order *models.Order) decimal.Decimal {
+	distance := order.TrailingDelta
+	if distance.IsZero() {
+		distance = order.Watermark.Mul(order.CallbackRate)
+	}
+	if order.Side == types.Sell {
+		return order.Watermark.Sub(distance)
+	}
+	return order.Watermark.Add(distance)
+}
@@ -0,0 +1,319 @@
+package matching
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/journal"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/snapshot"
+	"github.com/xhcdpg/crypto-trade/types"
+	"log"
+	"time"
+)
+
+const (
+	commandBufferSize = 1024
+	submitTimeout     = 5 * time.Second
+)
+
+var (
+	errShutDown   = errors.New("matching engine is shut down")
+	errBookHalted = errors.New("order book is halted after a failed command")
+)
+
+type commandType string
+
+const (
+	placeCommand      commandType = "place"
+	placeGroupCommand commandType = "place_group"
+	cancelCommand     commandType = "cancel"
+	cancelAllCommand  commandType = "cancel_all"
+	amendCommand      commandType = "amend"
+	triggerCommand    commandType = "trigger"
+	expireCommand     commandType = "expire"
+	priceCommand      commandType = "price"
+	stateCommand      commandType = "state"
+	breakerCommand    commandType = "breaker"
+	markCommand       commandType = "mark"
+	queryCommand      commandType = "query"
+	recoverCommand    commandType = "recover"
+)
+
+type command struct {
+	kind          commandType
+	order         *models.Order
+	orders        []*models.Order
+	user          *models.User
+	orderID       string
+	clientOrderID string
+	userID        string
+	price         decimal.Decimal
+	stopPrice     decimal.Decimal
+	working       types.WorkingType
+	status        types.InstrumentStatus
+	reason        string
+	quantity      decimal.Decimal
+	time          time.Time
+	query         func(ob *OrderBook)
+	snapshot      *snapshot.Snapshot
+	entries       []*journal.Entry
+	callerOrders  []*models.Order // the submitted orders, updated from the book's copies once placed
+	publisher     message.Publisher
+	result        chan error
+}
+
+// bookWorker is the single goroutine allowed to touch its OrderBook. Every read and
+// write goes through the commands channel, so commands on one symbol are applied
+// strictly in arrival order while different symbols match in parallel.
+type bookWorker struct {
+	book     *OrderBook
+	commands chan *command
+	done     chan struct{}
+	failed   bool // set when a command panicked, the book may be half updated
+}
+
+// run handles commands until the engine is stopping, then drains the commands already queued.
+func (w *bookWorker) run(m *MatchingEngine) {
+	defer close(w.done)
+	for {
+		select {
+		case cmd := <-w.commands:
+			w.handle(m, cmd)
+		case <-m.stopping:
+			for {
+				select {
+				case cmd := <-w.commands:
+					w.handle(m, cmd)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// handle executes one command. A command that panicked may have been journaled and half
+// applied, so the book can no longer be trusted: the symbol is halted and every later command
+// is refused with errBookHalted, rather than killing the worker and leaving them waiting forever.
+func (w *bookWorker) handle(m *MatchingEngine, cmd *command) {
+	if w.failed {
+		cmd.result <- errBookHalted
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("command", cmd.kind, "on", w.book.Symbol, "panicked, halting the book:", r)
+			w.failed = true
+			if err := m.instruments.SetStatus(w.book.Symbol, types.Halted); err != nil {
+				log.Println("failed to halt", w.book.Symbol, err)
+			}
+			cmd.result <- fmt.Errorf("%w: %v", errBookHalted, r)
+		}
+	}()
+	if cmd.publisher != nil {
+		cmd.publisher = &sequencedPublisher{publisher: cmd.publisher, book: w.book}
+	}
+	cmd.result <- m.execute(w.book, cmd)
+}
+
+func (m *MatchingEngine) execute(ob *OrderBook, cmd *command) error {
+	err := m.dispatch(ob, cmd)
+	switch cmd.kind {
+	case queryCommand, recoverCommand:
+	default:
+		m.afterCommand(ob, cmd.publisher)
+	}
+	reportOrders(cmd)
+	return err
+}
+
+// reportOrders copies the state of placed orders back into the orders of the caller, which the
+// worker does not touch afterwards.
+func reportOrders(cmd *command) {
+	placed := cmd.orders
+	if cmd.kind == placeCommand {
+		placed = []*models.Order{cmd.order}
+	}
+	for i, order := range cmd.callerOrders {
+		*order = *placed[i]
+	}
+}
+
+// afterCommand settles the consequences of a command that changed the book: order groups
+// first, then the circuit breaker, the auction price and the stops triggered by the prices it moved.
+func (m *MatchingEngine) afterCommand(ob *OrderBook, publisher message.Publisher) {
+	if err := m.resolveGroups(ob, publisher); err != nil {
+		log.Println("failed to resolve order groups", err)
+	}
+	m.checkCircuitBreaker(ob, publisher)
+	if err := m.publishIndicative(ob, publisher); err != nil {
+		log.Println("failed to publish auction price", err)
+	}
+	if ob.checkStops {
+		m.triggerStops(ob, publisher)
+	}
+}
+
+func (m *MatchingEngine) dispatch(ob *OrderBook, cmd *command) error {
+	switch cmd.kind {
+	case placeCommand:
+		return m.placeOrder(ob, cmd.order, cmd.user, cmd.publisher)
+	case placeGroupCommand:
+		return m.placeOrderGroup(ob, cmd.orders, cmd.user, cmd.publisher)
+	case cancelCommand:
+		if cmd.clientOrderID != "" {
+			return m.cancelClientOrder(ob, cmd.clientOrderID, cmd.userID, cmd.publisher)
+		}
+		return m.cancelOrder(ob, cmd.orderID, cmd.userID, cmd.publisher)
+	case cancelAllCommand:
+		return m.cancelAllOrders(ob, cmd.userID, cmd.publisher)
+	case amendCommand:
+		return m.amendOrder(ob, cmd, cmd.publisher)
+	case triggerCommand:
+		ob.checkStops = true
+		return nil
+	case expireCommand:
+		return m.expireOrders(ob, cmd.time, cmd.publisher)
+	case priceCommand:
+		ob.setPrice(cmd.working, cmd.price)
+		if cmd.working == types.MarkPrice {
+			return m.positionManager.Revalue(ob.Symbol, cmd.price)
+		}
+		return nil
+	case markCommand:
+		return m.tickMarkPrice(ob)
+	case stateCommand:
+		return m.setTradingState(ob, cmd.status, cmd.reason, time.Time{}, cmd.publisher)
+	case breakerCommand:
+		return m.resumeAfterCooldown(ob, cmd.time, cmd.publisher)
+	case queryCommand:
+		cmd.query(ob)
+		return nil
+	case recoverCommand:
+		return m.recoverBook(ob, cmd.snapshot, cmd.entries)
+	}
+	return errors.New("unknown command: " + string(cmd.kind))
+}
+
+// getWorker returns the worker owning the book of a registered instrument, starting it on first use.
+func (m *MatchingEngine) getWorker(symbol string) (*bookWorker, error) {
+	m.mutex.RLock()
+	w, ok := m.workers[symbol]
+	m.mutex.RUnlock()
+	if ok {
+		return w, nil
+	}
+
+	if _, err := m.instruments.Get(symbol); err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return nil, errShutDown
+	}
+	if w, ok := m.workers[symbol]; ok {
+		return w, nil
+	}
+	book := NewOrderBook(symbol)
+	book.clientOrders.owners = m.clientOrders
+	w = &bookWorker{
+		book:     book,
+		commands: make(chan *command, commandBufferSize),
+		done:     make(chan struct{}),
+	}
+	m.workers[symbol] = w
+	go w.run(m)
+	return w, nil
+}
+
+// submit hands a command to the symbol's worker and waits for its result. When the worker's
+// queue stays full for submitTimeout the command is refused instead of piling up.
+func (m *MatchingEngine) submit(symbol string, cmd *command) error {
+	w, err := m.getWorker(symbol)
+	if err != nil {
+		return err
+	}
+	return m.send(w, cmd)
+}
+
+// send queues the command without holding the engine lock, so a full queue only blocks its own
+// sender. A command queued after the worker drained on shutdown is answered as shut down.
+func (m *MatchingEngine) send(w *bookWorker, cmd *command) error {
+	cmd.result = make(chan error, 1)
+
+	timer := time.NewTimer(submitTimeout)
+	defer timer.Stop()
+	select {
+	case <-m.stopping:
+		return errShutDown
+	default:
+	}
+	select {
+	case w.commands <- cmd:
+	case <-m.stopping:
+		return errShutDown
+	case <-timer.C:
+		return errors.New("matching engine is busy")
+	}
+
+	select {
+	case err := <-cmd.result:
+		return err
+	case <-w.done:
+		select {
+		case err := <-cmd.result:
+			return err
+		default:
+			return errShutDown
+		}
+	}
+}
+
+// broadcast sends a copy of the command to every book worker, stopping at the first error.
+// Halted books are skipped.
+func (m *MatchingEngine) broadcast(cmd command) error {
+	for _, w := range m.getWorkers() {
+		c := cmd
+		if err := m.send(w, &c); err != nil && !errors.Is(err, errBookHalted) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MatchingEngine) getWorkers() []*bookWorker {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	workers := make([]*bookWorker, 0, len(m.workers))
+	for _, w := range m.workers {
+		workers = append(workers, w)
+	}
+	return workers
+}
+
+// Shutdown stops accepting commands, lets every worker drain the commands already
+// queued and waits for them to exit or for ctx to be done.
+func (m *MatchingEngine) Shutdown(ctx context.Context) error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.stopping)
+	m.mutex.Unlock()
+
+	for _, w := range m.getWorkers() {
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package matching
+
+import (
+	"errors"
+	"github.com/xhcdpg/crypto-trade/types"
+	"testing"
+	"time"
+)
+
+func TestPanicHaltsBook(t *testing.T) {
+	engine := newTestEngine(t)
+	engine.place(t, newTestOrder("maker", types.Sell, types.Limit, "100", "1"))
+
+	err := engine.submit(testSymbol, &command{kind: queryCommand, query: func(ob *OrderBook) {
+		panic("half applied")
+	}})
+	if !errors.Is(err, errBookHalted) {
+		t.Fatalf("panicking command returned %v, want %v", err, errBookHalted)
+	}
+	inst, err := engine.instruments.Get(testSymbol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.Status != types.Halted {
+		t.Fatalf("status after panic = %s, want %s", inst.Status, types.Halted)
+	}
+
+	err = engine.PlaceOrder(newTestOrder("taker", types.Buy, types.Limit, "100", "1"), engine.publisher)
+	if !errors.Is(err, errBookHalted) {
+		t.Fatalf("order after panic returned %v, want %v", err, errBookHalted)
+	}
+	if err := engine.ExpireOrders(time.Now(), engine.publisher); err != nil {
+		t.Fatalf("broadcast did not skip the halted book: %v", err)
+	}
+	if err := engine.TakeSnapshots(); err != nil {
+		t.Fatalf("snapshots did not skip the halted book: %v", err)
+	}
+}
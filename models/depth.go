@@ -0,0 +1,61 @@
+package models
+
+import (
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"time"
+)
+
+// PriceLevel is one aggregated level of L2 depth.
+type PriceLevel struct {
+	Price    decimal.Decimal `json:"price"`
+	Quantity decimal.Decimal `json:"quantity"`
+	Orders   int             `json:"orders"`
+}
+
+type Depth struct {
+	Symbol   string       `json:"symbol"`
+	Sequence uint64       `json:"sequence"`
+	Bids     []PriceLevel `json:"bids"`
+	Asks     []PriceLevel `json:"asks"`
+}
+
+// BookOrder is one resting order of L3 depth, without the owner's identity.
+type BookOrder struct {
+	OrderID   string          `json:"order_id"`
+	Quantity  decimal.Decimal `json:"quantity"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+type OrderLevel struct {
+	Price  decimal.Decimal `json:"price"`
+	Orders []BookOrder     `json:"orders"`
+}
+
+type OrderDepth struct {
+	Symbol   string       `json:"symbol"`
+	Sequence uint64       `json:"sequence"`
+	Bids     []OrderLevel `json:"bids"`
+	Asks     []OrderLevel `json:"asks"`
+}
+
+type BookTicker struct {
+	Symbol          string          `json:"symbol"`
+	Sequence        uint64          `json:"sequence"`
+	BestBid         decimal.Decimal `json:"best_bid"`
+	BestBidQuantity decimal.Decimal `json:"best_bid_quantity"`
+	BestAsk         decimal.Decimal `json:"best_ask"`
+	BestAskQuantity decimal.Decimal `json:"best_ask_quantity"`
+	Spread          decimal.Decimal `json:"spread"`
+	Imbalance       decimal.Decimal `json:"imbalance"` // (买量-卖量)/(买量+卖量)
+}
+
+// AuctionPrice is the equilibrium of a call auction: the price maximizing the executed
+// volume if the auction ended now, and the volume left unmatched at that price.
+type AuctionPrice struct {
+	Symbol    string          `json:"symbol"`
+	Sequence  uint64          `json:"sequence"`
+	Price     decimal.Decimal `json:"price"`
+	Volume    decimal.Decimal `json:"volume"`
+	Surplus   decimal.Decimal `json:"surplus"` // 买方剩余为正, 卖方剩余为负
+	Timestamp time.Time       `json:"timestamp"`
+}
@@ -1,10 +1,13 @@
 package models
 
-import "time"
+import (
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"time"
+)
 
 type FoundingPayment struct {
 	UserID string
 	Symbol string
-	Amount float64
+	Amount decimal.Decimal
 	Time   time.Time
 }
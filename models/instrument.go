@@ -0,0 +1,40 @@
+package models
+
+import (
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/types"
+	"time"
+)
+
+// Instrument holds the trading rules of a symbol. Prices and quantities must be multiples of
+// TickSize and LotSize, which must fit the price and quantity precision of the instrument;
+// decimal.Precision is only the finest step they may use.
+type Instrument struct {
+	Symbol                 string                 `json:"symbol"`
+	BaseAsset              string                 `json:"base_asset"`
+	QuoteAsset             string                 `json:"quote_asset"`
+	ContractType           types.ContractType     `json:"contract_type"`
+	TickSize               decimal.Decimal        `json:"tick_size"`          // 最小价格变动
+	LotSize                decimal.Decimal        `json:"lot_size"`           // 最小数量变动
+	PricePrecision         int32                  `json:"price_precision"`    // 价格小数位数, 0 uses the places of TickSize
+	QuantityPrecision      int32                  `json:"quantity_precision"` // 数量小数位数, 0 uses the places of LotSize
+	MinQuantity            decimal.Decimal        `json:"min_quantity"`
+	MaxQuantity            decimal.Decimal        `json:"max_quantity"` // 0 表示不限制
+	MinNotional            decimal.Decimal        `json:"min_notional"` // 最小名义价值
+	MaxNotional            decimal.Decimal        `json:"max_notional"` // 最大名义价值, 0 uses instrument.DefaultMaxNotional
+	MaxLeverage            uint                   `json:"max_leverage"`
+	MaxSlippage            decimal.Decimal        `json:"max_slippage"`             // 市价单最大滑点比例, 0 表示不限制
+	PriceBand              decimal.Decimal        `json:"price_band"`               // 限价单偏离标记价格的最大比例, 0 表示不限制
+	CircuitBreakerPercent  decimal.Decimal        `json:"circuit_breaker_percent"`  // 熔断: 窗口内价格波动超过该比例则暂停交易, 0 表示不启用
+	CircuitBreakerWindow   uint                   `json:"circuit_breaker_window"`   // 熔断统计窗口(秒)
+	CircuitBreakerCooldown uint                   `json:"circuit_breaker_cooldown"` // 熔断后自动恢复的秒数, 0 表示手动恢复
+	Status                 types.InstrumentStatus `json:"status"`
+}
+
+type TradingStateChange struct {
+	Symbol    string                 `json:"symbol"`
+	From      types.InstrumentStatus `json:"from"`
+	To        types.InstrumentStatus `json:"to"`
+	Reason    string                 `json:"reason"`
+	Timestamp time.Time              `json:"timestamp"`
+}
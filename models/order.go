@@ -1,21 +1,40 @@
 package models
 
 import (
+	"github.com/xhcdpg/crypto-trade/decimal"
 	"github.com/xhcdpg/crypto-trade/types"
 	"time"
 )
 
 type Order struct {
-	ID         string
-	UserID     string
-	Symbol     string
-	Side       types.Side
-	Type       types.OrderType
-	Leverage   uint
-	Quantity   float64
-	Price      float64 // 委托价
-	StopPrice  float64 // 触发价/止盈价/止损价
-	Status     types.OrderStatus
-	MarginType types.MarginMode
-	Timestamp  time.Time
+	ID              string
+	ClientOrderID   string // 客户端订单号, unique per user across symbols while its order is remembered
+	UserID          string
+	Symbol          string
+	Side            types.Side
+	Type            types.OrderType
+	Leverage        uint
+	Quantity        decimal.Decimal
+	FilledQuantity  decimal.Decimal
+	DisplayQuantity decimal.Decimal   // 冰山单每次显示的数量, zero shows the whole order
+	AveragePrice    decimal.Decimal   // 成交均价
+	Price           decimal.Decimal   // 委托价
+	StopPrice       decimal.Decimal   // 触发价/止盈价/止损价
+	WorkingType     types.WorkingType // 触发价格类型, last price by default
+	CallbackRate    decimal.Decimal   // 跟踪止损回调比例, e.g. 0.01 for 1%
+	TrailingDelta   decimal.Decimal   // 跟踪止损回调价差, used instead of CallbackRate
+	ActivationPrice decimal.Decimal   // 跟踪止损激活价, zero activates immediately
+	Watermark       decimal.Decimal   // 激活后的最高价(卖)/最低价(买), zero until activated
+	Status          types.OrderStatus
+	TimeInForce     types.TimeInForce
+	ExpireTime      time.Time // GTD 过期时间
+	MarginType      types.MarginMode
+	PositionSide    types.PositionSide // 持仓方向, long or short in hedge mode
+	ParentID        string             // 括号单的入场单, the order waits until that entry order is done
+	OCOGroupID      string             // 二选一订单组, once one order of the group fills or triggers the others are cancelled
+	ReduceOnly      bool               // 只减仓
+	ClosePosition   bool               // 触发后平掉全部仓位, quantity follows the position
+	STPMode         types.SelfTradePrevention
+	STPGroupID      string // orders of different users in the same group are also prevented from matching
+	Timestamp       time.Time
 }
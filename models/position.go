@@ -1,21 +1,25 @@
 package models
 
-import "github.com/xhcdpg/crypto-trade/types"
+import (
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/types"
+)
 
 type Position struct {
 	ID                string
 	UserID            string
 	Symbol            string
 	Side              types.Side
+	PositionSide      types.PositionSide // both in one-way mode, long or short in hedge mode
 	ContractType      string
 	Leverage          uint
-	EntryPrice        float64
-	Quantity          float64
-	AllocatedMargin   float64
-	MarkPrice         float64
-	UnrealizedPnl     float64
-	RealizedPnl       float64
-	MaintenanceMargin float64
-	InitialMargin     float64
-	LiquidationPrice  float64
+	EntryPrice        decimal.Decimal
+	Quantity          decimal.Decimal
+	AllocatedMargin   decimal.Decimal
+	MarkPrice         decimal.Decimal
+	UnrealizedPnl     decimal.Decimal
+	RealizedPnl       decimal.Decimal
+	MaintenanceMargin decimal.Decimal
+	InitialMargin     decimal.Decimal
+	LiquidationPrice  decimal.Decimal
 }
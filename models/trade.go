@@ -1,6 +1,7 @@
 package models
 
 import (
+	"github.com/xhcdpg/crypto-trade/decimal"
 	"time"
 )
 
@@ -9,7 +10,7 @@ type Trade struct {
 	Symbol    string
 	BuyerID   string
 	SellerID  string
-	Price     float64
-	Quantity  float64
+	Price     decimal.Decimal
+	Quantity  decimal.Decimal
 	Timestamp time.Time
 }
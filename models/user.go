@@ -1,13 +1,17 @@
 package models
 
-import "github.com/xhcdpg/crypto-trade/types"
+import (
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/types"
+)
 
 type User struct {
-	ID           string           `json:"id"`
-	Username     string           `json:"username"`
-	Email        string           `json:"email"`
-	PasswordHash string           `json:"password_hash"`
-	TotalBalance float64          `json:"total_balance"`
-	MarginMode   types.MarginMode `json:"margin_mode"`
-	Positions    []Position       `json:"positions"`
+	ID           string             `json:"id"`
+	Username     string             `json:"username"`
+	Email        string             `json:"email"`
+	PasswordHash string             `json:"password_hash"`
+	TotalBalance decimal.Decimal    `json:"total_balance"`
+	MarginMode   types.MarginMode   `json:"margin_mode"`
+	PositionMode types.PositionMode `json:"position_mode"`
+	Positions    []Position         `json:"positions"`
 }
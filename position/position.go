@@ -1,8 +1,12 @@
 package position
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/google/uuid"
+	"github.com/xhcdpg/crypto-trade/decimal"
 	"github.com/xhcdpg/crypto-trade/models"
 	"github.com/xhcdpg/crypto-trade/types"
 	u "github.com/xhcdpg/crypto-trade/user"
@@ -10,7 +14,7 @@ import (
 )
 
 type PositionManager struct {
-	positions map[string]map[string]*models.Position
+	positions map[string]map[string]*models.Position // by user id, then symbol and position side
 	publisher message.Publisher
 	mutex     sync.Mutex
 }
@@ -22,15 +26,18 @@ func NewPositionManager(publisher message.Publisher) *PositionManager {
 	}
 }
 
-func (pm *PositionManager) getOrCreatePosition(userID, symbol string) *models.Position {
-	pm.mutex.Lock()
-	defer pm.mutex.Unlock()
+func positionKey(symbol string, positionSide types.PositionSide) string {
+	return symbol + "/" + string(positionSide)
+}
 
+// getOrCreatePosition must be called with the mutex held.
+func (pm *PositionManager) getOrCreatePosition(userID, symbol string, positionSide types.PositionSide) *models.Position {
 	if _, ok := pm.positions[userID]; !ok {
 		pm.positions[userID] = make(map[string]*models.Position)
 	}
 
-	if position, ok := pm.positions[userID][symbol]; ok {
+	key := positionKey(symbol, positionSide)
+	if position, ok := pm.positions[userID][key]; ok {
 		return position
 	}
 
@@ -38,40 +45,61 @@ func (pm *PositionManager) getOrCreatePosition(userID, symbol string) *models.Po
 		ID:                uuid.New().String(),
 		UserID:            userID,
 		Symbol:            symbol,
-		Quantity:          0.0,
-		EntryPrice:        0.0,
-		MarkPrice:         0.0,
-		UnrealizedPnl:     0.0,
-		RealizedPnl:       0.0,
-		AllocatedMargin:   0.0,
+		PositionSide:      positionSide,
+		Quantity:          decimal.Zero,
+		EntryPrice:        decimal.Zero,
+		MarkPrice:         decimal.Zero,
+		UnrealizedPnl:     decimal.Zero,
+		RealizedPnl:       decimal.Zero,
+		AllocatedMargin:   decimal.Zero,
 		Leverage:          1,
-		MaintenanceMargin: 0.0,
-		InitialMargin:     0.0,
-		LiquidationPrice:  0.0,
+		MaintenanceMargin: decimal.Zero,
+		InitialMargin:     decimal.Zero,
+		LiquidationPrice:  decimal.Zero,
 	}
-	pm.positions[userID][symbol] = newPosition
+	pm.positions[userID][key] = newPosition
 	return newPosition
 }
 
-func (pm *PositionManager) GetPosition(userID, symbol string) *models.Position {
+// GetPosition returns the position of the user on one side: types.Both in one-way mode,
+// types.Long or types.Short in hedge mode.
+func (pm *PositionManager) GetPosition(userID, symbol string, positionSide types.PositionSide) *models.Position {
 	pm.mutex.Lock()
 	defer pm.mutex.Unlock()
 	if userPositions, ok := pm.positions[userID]; ok {
-		if position, ok := userPositions[symbol]; ok {
+		if position, ok := userPositions[positionKey(symbol, positionSide)]; ok {
 			return position
 		}
 	}
 	return nil
 }
 
+// SetPositionMode switches the user between one-way and hedge mode, which is only allowed
+// while the user has no open position. Use MatchingEngine.SetPositionMode, which also checks
+// the user's open orders.
+func (pm *PositionManager) SetPositionMode(user *models.User, mode types.PositionMode) error {
+	pm.mutex.Lock()
+	for _, position := range pm.positions[user.ID] {
+		if !position.Quantity.IsZero() {
+			pm.mutex.Unlock()
+			return errors.New("position mode cannot be changed with open positions")
+		}
+	}
+	pm.mutex.Unlock()
+	return u.GlobalUserService.SetPositionMode(user, mode)
+}
+
 func (pm *PositionManager) GetAllPositions() []*models.Position {
 	pm.mutex.Lock()
 	defer pm.mutex.Unlock()
+	return pm.openPositions()
+}
 
+func (pm *PositionManager) openPositions() []*models.Position {
 	var allPositions []*models.Position
 	for _, userPositions := range pm.positions {
 		for _, position := range userPositions {
-			if position.Quantity != 0 {
+			if !position.Quantity.IsZero() {
 				allPositions = append(allPositions, position)
 			}
 		}
@@ -80,51 +108,137 @@ func (pm *PositionManager) GetAllPositions() []*models.Position {
 	return allPositions
 }
 
-func (pm *PositionManager) UpdatePositionFromTrade(trade *models.Trade, leverage uint, marginType types.MarginMode) error {
-	var (
-		position *models.Position
-		side     types.Side
-	)
+// Revalue marks every open position of the symbol to the mark price and publishes the
+// updated positions on "position_updated".
+func (pm *PositionManager) Revalue(symbol string, markPrice decimal.Decimal) error {
+	var updated []models.Position
+	pm.mutex.Lock()
+	for _, position := range pm.openPositions() {
+		if position.Symbol == symbol {
+			revalue(position, markPrice)
+			updated = append(updated, *position)
+		}
+	}
+	pm.mutex.Unlock()
+
+	for i := range updated {
+		if err := pm.publishPosition(&updated[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if trade.BuyerID != types.SystemID {
-		position = pm.getOrCreatePosition(trade.BuyerID, trade.Symbol)
-		side = types.Buy
-	} else {
-		position = pm.getOrCreatePosition(trade.SellerID, trade.Symbol)
-		side = types.Sell
+// revalue sets the unrealized PnL of the position at the mark price.
+func revalue(position *models.Position, markPrice decimal.Decimal) {
+	position.MarkPrice = markPrice
+	position.UnrealizedPnl = markPrice.Sub(position.EntryPrice).Mul(position.Quantity)
+	if position.Side == types.Sell {
+		position.UnrealizedPnl = position.UnrealizedPnl.Neg()
 	}
+}
 
-	user, err := u.GlobalUserService.GetUser(trade.ID)
+func (pm *PositionManager) publishPosition(position *models.Position) error {
+	if pm.publisher == nil {
+		return nil
+	}
+	positionJson, err := json.Marshal(position)
 	if err != nil {
 		return err
 	}
+	return pm.publisher.Publish("position_updated", message.NewMessage(uuid.New().String(), positionJson))
+}
 
-	if position.Quantity == 0 {
-		// new position
-		position.EntryPrice = trade.Price
-	} else {
-		if position.Side == types.Buy {
-			if side == types.Buy {
-				totalQuantity := position.Quantity + trade.Quantity
-				position.EntryPrice = (position.EntryPrice*position.Quantity + trade.Price*trade.Quantity) / totalQuantity
-			} else {
-				// reverse open position
-				// close position
-				if position.Quantity > trade.Quantity {
-					position.Quantity -= trade.Quantity
-					position.RealizedPnl += (trade.Price - position.EntryPrice) * trade.Quantity
-				} else {
-
-				}
-			}
-		} else {
-			if side == types.Buy {
+// UpdatePositionFromTrade applies a fill to the position of the order's position side and credits
+// the realized PnL to the user's balance. In one-way mode the fill opens, adds to, reduces, closes
+// or reverses the net position. In hedge mode the long and short legs are independent: a fill
+// opens or adds to its leg or reduces it, but never reverses it.
+func (pm *PositionManager) UpdatePositionFromTrade(trade *models.Trade, userID string, side types.Side, positionSide types.PositionSide, leverage uint, marginType types.MarginMode) error {
+	user, err := u.GlobalUserService.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	if positionSide == "" {
+		positionSide = types.Both
+	}
+
+	pm.mutex.Lock()
+	position := pm.getOrCreatePosition(userID, trade.Symbol, positionSide)
+	if positionSide != types.Both && !OpensPosition(positionSide, side) && trade.Quantity.GreaterThan(position.Quantity) {
+		// the matching engine clips closing orders to their leg before every fill
+		pm.mutex.Unlock()
+		return fmt.Errorf("fill of %s exceeds %s position %s of %s on %s", trade.Quantity, positionSide, position.Quantity, userID, trade.Symbol)
+	}
+	realized := netTrade(position, side, trade.Price, trade.Quantity, leverage, marginType == types.IsolatedMargin)
+	if position.MarkPrice.IsPositive() {
+		revalue(position, position.MarkPrice)
+	}
+	updated := *position
+	pm.mutex.Unlock()
 
-			} else {
+	if !realized.IsZero() {
+		u.GlobalUserService.Deposit(user, realized)
+	}
+	return pm.publishPosition(&updated)
+}
 
-			}
+// OpensPosition reports whether an order side opens or adds to a hedge mode position side.
+func OpensPosition(positionSide types.PositionSide, side types.Side) bool {
+	return positionSide == types.Long && side == types.Buy || positionSide == types.Short && side == types.Sell
+}
+
+// netTrade applies a fill of quantity at price to the position. The part of the fill on the
+// opposite side closes the position first at its entry price, any excess opens a new position
+// on the fill's side. It returns the PnL realized by the closed quantity.
+func netTrade(position *models.Position, side types.Side, price, quantity decimal.Decimal, leverage uint, isolated bool) (realized decimal.Decimal) {
+	if position.Quantity.IsPositive() && position.Side != side {
+		closed := decimal.Min(quantity, position.Quantity)
+		if position.Side == types.Buy {
+			realized = price.Sub(position.EntryPrice).Mul(closed)
+		} else {
+			realized = position.EntryPrice.Sub(price).Mul(closed)
+		}
+		position.RealizedPnl = position.RealizedPnl.Add(realized)
+
+		if closed.Equal(position.Quantity) {
+			position.Quantity = decimal.Zero
+			position.EntryPrice = decimal.Zero
+			position.InitialMargin = decimal.Zero
+			position.AllocatedMargin = decimal.Zero
+			position.MaintenanceMargin = decimal.Zero
+			position.UnrealizedPnl = decimal.Zero
+			position.LiquidationPrice = decimal.Zero
+		} else {
+			// margin is released in proportion to the closed quantity
+			releasedInitial := position.InitialMargin.Mul(closed).Div(position.Quantity)
+			releasedAllocated := position.AllocatedMargin.Mul(closed).Div(position.Quantity)
+			position.InitialMargin = position.InitialMargin.Sub(releasedInitial)
+			position.AllocatedMargin = position.AllocatedMargin.Sub(releasedAllocated)
+			position.Quantity = position.Quantity.Sub(closed)
 		}
+		quantity = quantity.Sub(closed)
+	}
+	if !quantity.IsPositive() {
+		return realized
 	}
 
-	return nil
+	if leverage == 0 {
+		leverage = 1
+	}
+	margin := price.Mul(quantity).Div(decimal.NewFromInt(int64(leverage)))
+	if position.Quantity.IsZero() {
+		// new position, or the rest of a fill that reversed the position through zero
+		position.Side = side
+		position.EntryPrice = price
+	} else {
+		total := position.Quantity.Add(quantity)
+		position.EntryPrice = position.EntryPrice.Mul(position.Quantity).Add(price.Mul(quantity)).Div(total)
+	}
+	position.Quantity = position.Quantity.Add(quantity)
+	position.Leverage = leverage
+	position.InitialMargin = position.InitialMargin.Add(margin)
+	if isolated {
+		position.AllocatedMargin = position.AllocatedMargin.Add(margin)
+	}
+	return realized
 }
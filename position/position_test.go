@@ -0,0 +1,89 @@
+package position
+
+import (
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/types"
+	"testing"
+)
+
+type fill struct {
+	side     types.Side
+	price    string
+	quantity string
+}
+
+func TestNetTrade(t *testing.T) {
+	tests := []struct {
+		name     string
+		isolated bool
+		fills    []fill
+		// expected after the last fill
+		realized string
+		side     types.Side
+		quantity string
+		entry    string
+		initial  string
+		allocate string
+	}{
+		{
+			name:     "open",
+			isolated: true,
+			fills:    []fill{{types.Buy, "100", "2"}},
+			realized: "0", side: types.Buy, quantity: "2", entry: "100", initial: "20", allocate: "20",
+		},
+		{
+			name:     "add",
+			isolated: true,
+			fills:    []fill{{types.Buy, "100", "1"}, {types.Buy, "130", "2"}},
+			realized: "0", side: types.Buy, quantity: "3", entry: "120", initial: "36", allocate: "36",
+		},
+		{
+			name:     "partial reduce",
+			isolated: true,
+			fills:    []fill{{types.Buy, "100", "4"}, {types.Sell, "110", "1"}},
+			realized: "10", side: types.Buy, quantity: "3", entry: "100", initial: "30", allocate: "30",
+		},
+		{
+			name:     "full close",
+			isolated: true,
+			fills:    []fill{{types.Sell, "100", "2"}, {types.Buy, "90", "2"}},
+			realized: "20", side: types.Sell, quantity: "0", entry: "0", initial: "0", allocate: "0",
+		},
+		{
+			name:     "reverse through zero",
+			isolated: true,
+			fills:    []fill{{types.Buy, "100", "1"}, {types.Sell, "95", "3"}},
+			realized: "-5", side: types.Sell, quantity: "2", entry: "95", initial: "19", allocate: "19",
+		},
+		{
+			name:     "cross allocates no margin",
+			fills:    []fill{{types.Buy, "100", "2"}, {types.Sell, "120", "1"}},
+			realized: "20", side: types.Buy, quantity: "1", entry: "100", initial: "10", allocate: "0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			position := &models.Position{}
+			var realized decimal.Decimal
+			for _, f := range tt.fills {
+				realized = netTrade(position, f.side, decimal.RequireFromString(f.price), decimal.RequireFromString(f.quantity), 10, tt.isolated)
+			}
+
+			check := func(field string, got decimal.Decimal, want string) {
+				if !got.Equal(decimal.RequireFromString(want)) {
+					t.Errorf("%s = %s, want %s", field, got, want)
+				}
+			}
+			check("realized", realized, tt.realized)
+			check("quantity", position.Quantity, tt.quantity)
+			check("entry price", position.EntryPrice, tt.entry)
+			check("initial margin", position.InitialMargin, tt.initial)
+			check("allocated margin", position.AllocatedMargin, tt.allocate)
+			if position.Quantity.IsPositive() && position.Side != tt.side {
+				t.Errorf("side = %s, want %s", position.Side, tt.side)
+			}
+		})
+	}
+}
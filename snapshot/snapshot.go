@@ -0,0 +1,190 @@
+package snapshot
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xhcdpg/crypto-trade/decimal"
+	"github.com/xhcdpg/crypto-trade/models"
+	"github.com/xhcdpg/crypto-trade/types"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Snapshot is the full state of one order book after the command with the given sequence number.
+// Bids and Asks are listed in priority order.
+type Snapshot struct {
+	Symbol    string                     `json:"symbol"`
+	Sequence  uint64                     `json:"sequence"`
+	Bids      []*models.Order            `json:"bids"`
+	Asks      []*models.Order            `json:"asks"`
+	Stops     []*models.Order            `json:"stops"`
+	LastPrice decimal.Decimal            `json:"last_price"`
+	Legs      []*models.Order            `json:"legs,omitempty"`       // bracket legs waiting for their entry order
+	Visible   map[string]decimal.Decimal `json:"visible,omitempty"`    // quantity shown by each iceberg order, by order id
+	Auction   bool                       `json:"auction,omitempty"`    // the book is collecting orders for a call auction
+	Status    types.InstrumentStatus     `json:"status,omitempty"`     // trading state of the symbol
+	Messages  map[string]uint64          `json:"messages,omitempty"`   // messages published so far, by topic
+	Closed    []*models.Order            `json:"closed,omitempty"`     // closed orders remembered by client order id, oldest first
+	TrippedAt *time.Time                 `json:"tripped_at,omitempty"` // when the circuit breaker halted the symbol
+	Checksum  string                     `json:"checksum"`
+	CreatedAt time.Time                  `json:"created_at"`
+}
+
+// ComputeChecksum hashes the book content of the snapshot, excluding Checksum and CreatedAt.
+func (s *Snapshot) ComputeChecksum() (string, error) {
+	data, err := json.Marshal(struct {
+		Symbol    string                     `json:"symbol"`
+		Sequence  uint64                     `json:"sequence"`
+		Bids      []*models.Order            `json:"bids"`
+		Asks      []*models.Order            `json:"asks"`
+		Stops     []*models.Order            `json:"stops"`
+		LastPrice decimal.Decimal            `json:"last_price"`
+		Legs      []*models.Order            `json:"legs,omitempty"`
+		Visible   map[string]decimal.Decimal `json:"visible,omitempty"`
+		Auction   bool                       `json:"auction,omitempty"`
+		Status    types.InstrumentStatus     `json:"status,omitempty"`
+		Messages  map[string]uint64          `json:"messages,omitempty"`
+		Closed    []*models.Order            `json:"closed,omitempty"`
+		TrippedAt *time.Time                 `json:"tripped_at,omitempty"`
+	}{s.Symbol, s.Sequence, s.Bids, s.Asks, s.Stops, s.LastPrice, s.Legs, s.Visible, s.Auction, s.Status, s.Messages, s.Closed, s.TrippedAt})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (s *Snapshot) Verify() error {
+	checksum, err := s.ComputeChecksum()
+	if err != nil {
+		return err
+	}
+	if checksum != s.Checksum {
+		return fmt.Errorf("snapshot checksum mismatch for %s#%d", s.Symbol, s.Sequence)
+	}
+	return nil
+}
+
+type Store interface {
+	Save(snapshot *Snapshot) error
+	// Latest returns the most recent snapshot of a symbol, or nil when there is none.
+	Latest(symbol string) (*Snapshot, error)
+}
+
+// FileStore writes one file per snapshot, named after the symbol and sequence number.
+type FileStore struct {
+	dir string
+}
+
+const fileExt = ".snapshot"
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (fs *FileStore) Save(snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%020d%s", snapshot.Symbol, snapshot.Sequence, fileExt)
+	tmp, err := os.CreateTemp(fs.dir, name+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(fs.dir, name))
+}
+
+func (fs *FileStore) Latest(symbol string) (*Snapshot, error) {
+	files, err := os.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	latest, latestSequence := "", uint64(0)
+	prefix := symbol + "-"
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, fileExt) {
+			continue
+		}
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, prefix), fileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		if latest == "" || sequence > latestSequence {
+			latest, latestSequence = name, sequence
+		}
+	}
+	if latest == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(fs.dir, latest))
+	if err != nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// PostgresStore keeps snapshots in the order_book_snapshots table.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (ps *PostgresStore) Save(snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = ps.db.Exec("INSERT INTO order_book_snapshots(symbol,sequence,data,checksum,created_at) VALUES($1,$2,$3,$4,$5)", snapshot.Symbol, int64(snapshot.Sequence), data, snapshot.Checksum, snapshot.CreatedAt)
+	return err
+}
+
+func (ps *PostgresStore) Latest(symbol string) (*Snapshot, error) {
+	var data []byte
+	err := ps.db.QueryRow("SELECT data FROM order_book_snapshots WHERE symbol=$1 ORDER BY sequence DESC LIMIT 1", symbol).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
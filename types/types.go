@@ -9,6 +9,23 @@ const (
 	IsolatedMargin MarginMode = "isolated"
 )
 
+// PositionMode decides whether a user holds one net position per symbol or a long and a short one.
+type PositionMode string
+
+const (
+	OneWay PositionMode = "one_way" // 单向持仓
+	Hedge  PositionMode = "hedge"   // 双向持仓
+)
+
+// PositionSide is the position an order trades on: both in one-way mode, long or short in hedge mode.
+type PositionSide string
+
+const (
+	Both  PositionSide = "both"
+	Long  PositionSide = "long"  // 多头仓位
+	Short PositionSide = "short" // 空头仓位
+)
+
 type OrderType string
 
 const (
@@ -18,15 +35,50 @@ const (
 	LimitTakeProfit  OrderType = "limit_take_profit"
 	MarketStopLoss   OrderType = "market_stop_loss"
 	MarketTakeProfit OrderType = "market_take_profit"
+	TrailingStop     OrderType = "trailing_stop" // 跟踪止损, triggers a market order
 )
 
 type OrderStatus string
 
 const (
-	Open      OrderStatus = "open" // 待撮合
-	Filled    OrderStatus = "filled"
-	Cancelled OrderStatus = "cancelled"
-	Pending   OrderStatus = "pending" // 待激活
+	Open            OrderStatus = "open" // 待撮合
+	PartiallyFilled OrderStatus = "partially_filled"
+	Filled          OrderStatus = "filled"
+	Cancelled       OrderStatus = "cancelled"
+	Expired         OrderStatus = "expired"
+	Pending         OrderStatus = "pending"   // 待激活
+	Triggered       OrderStatus = "triggered" // 已触发, the stop was turned into a new order
+)
+
+type TimeInForce string
+
+const (
+	GTC      TimeInForce = "gtc"       // 撤销前有效
+	IOC      TimeInForce = "ioc"       // 立即成交剩余撤销
+	FOK      TimeInForce = "fok"       // 全部成交否则撤销
+	GTD      TimeInForce = "gtd"       // 指定时间前有效
+	PostOnly TimeInForce = "post_only" // 只做maker
+)
+
+// SelfTradePrevention decides what happens when an order would match another order
+// of the same user or STP group. The taker's mode applies.
+type SelfTradePrevention string
+
+const (
+	STPNone               SelfTradePrevention = ""
+	STPCancelNewest       SelfTradePrevention = "cancel_newest"        // 撤销新单(taker)
+	STPCancelOldest       SelfTradePrevention = "cancel_oldest"        // 撤销旧单(maker)
+	STPCancelBoth         SelfTradePrevention = "cancel_both"          // 双方都撤销
+	STPDecrementAndCancel SelfTradePrevention = "decrement_and_cancel" // 双方减少数量,数量小的一方撤销
+)
+
+// WorkingType is the price series a stop order is triggered by.
+type WorkingType string
+
+const (
+	LastPrice  WorkingType = "last_price"  // 最新成交价
+	MarkPrice  WorkingType = "mark_price"  // 标记价格
+	IndexPrice WorkingType = "index_price" // 指数价格
 )
 
 type Side string
@@ -35,3 +87,20 @@ const (
 	Sell Side = "sell"
 	Buy  Side = "buy"
 )
+
+type ContractType string
+
+const (
+	Perpetual ContractType = "perpetual" // 永续合约
+	Delivery  ContractType = "delivery"  // 交割合约
+)
+
+type InstrumentStatus string
+
+const (
+	Trading    InstrumentStatus = "trading"
+	CancelOnly InstrumentStatus = "cancel_only" // 只能撤单
+	Halted     InstrumentStatus = "halted"      // 暂停交易, orders can neither be placed nor cancelled
+	Auction    InstrumentStatus = "auction"     // 集合竞价
+	Delisted   InstrumentStatus = "delisted"
+)
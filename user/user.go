@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"github.com/google/uuid"
+	"github.com/xhcdpg/crypto-trade/decimal"
 	"github.com/xhcdpg/crypto-trade/models"
 	"github.com/xhcdpg/crypto-trade/types"
 	"golang.org/x/crypto/bcrypt"
@@ -30,22 +31,27 @@ func (u *UserService) RegisterUser(username, email, password string, marginTMode
 	}
 
 	userID := uuid.New().String()
-	_, err = u.db.Exec("INSERT INTO users(id,username,email,password_hashed,total_balance,margin_mode) VALUES($1,$2,$3,$4,$5,$6)", userID, username, email, string(passwordHashed), 0.0, marginTMode)
+	_, err = u.db.Exec("INSERT INTO users(id,username,email,password_hashed,total_balance,margin_mode,position_mode) VALUES($1,$2,$3,$4,$5,$6,$7)", userID, username, email, string(passwordHashed), decimal.Zero, marginTMode, types.OneWay)
 
 	return err
 }
 
 func (u *UserService) GetUser(userID string) (*models.User, error) {
 	var (
-		user        models.User
-		marginTMode string
+		user         models.User
+		marginTMode  string
+		positionMode string
 	)
 
-	err := u.db.QueryRow("SELECT id,username,email,password_hashed,total_balance,margin_mode FROM users WHERE id=$1", userID).Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.TotalBalance, &marginTMode)
+	err := u.db.QueryRow("SELECT id,username,email,password_hashed,total_balance,margin_mode,position_mode FROM users WHERE id=$1", userID).Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.TotalBalance, &marginTMode, &positionMode)
 	if err != nil {
 		return nil, err
 	}
 	user.MarginMode = types.MarginMode(marginTMode)
+	user.PositionMode = types.PositionMode(positionMode)
+	if user.PositionMode == "" {
+		user.PositionMode = types.OneWay
+	}
 
 	// todo
 	user.Positions = []models.Position{}
@@ -53,13 +59,15 @@ func (u *UserService) GetUser(userID string) (*models.User, error) {
 	return &user, nil
 }
 
-func (u *UserService) Deposit(user *models.User, amount float64) {
-	user.TotalBalance += amount
-	u.db.Exec("UPDATE users SET total_balance = $1 WHERE id = $2", user.TotalBalance, user.ID)
+// Deposit adds amount to the user's balance. The row is updated relative to its current value,
+// so deposits of concurrent book workers on copies of the same user are not lost.
+func (u *UserService) Deposit(user *models.User, amount decimal.Decimal) {
+	user.TotalBalance = user.TotalBalance.Add(amount)
+	u.db.Exec("UPDATE users SET total_balance = total_balance + $1 WHERE id = $2", amount, user.ID)
 }
 
-func (u *UserService) AddMarginToPosition(user *models.User, positionID string, amount float64) error {
-	if user.TotalBalance < amount {
+func (u *UserService) AddMarginToPosition(user *models.User, positionID string, amount decimal.Decimal) error {
+	if user.TotalBalance.LessThan(amount) {
 		return errors.New("insufficient balance")
 	}
 	if user.MarginMode == types.CrossMargin {
@@ -68,12 +76,23 @@ func (u *UserService) AddMarginToPosition(user *models.User, positionID string,
 	}
 	for i, pos := range user.Positions {
 		if pos.ID == positionID {
-			user.Positions[i].AllocatedMargin += amount
-			user.TotalBalance -= amount
-			u.db.Exec("UPDATE users SET total_balance = $1 WHERE id = $2", user.TotalBalance, user.ID)
+			user.Positions[i].AllocatedMargin = user.Positions[i].AllocatedMargin.Add(amount)
+			user.TotalBalance = user.TotalBalance.Sub(amount)
+			u.db.Exec("UPDATE users SET total_balance = total_balance - $1 WHERE id = $2", amount, user.ID)
 			return nil
 		}
 	}
 
 	return errors.New("position not found")
 }
+
+func (u *UserService) SetPositionMode(user *models.User, mode types.PositionMode) error {
+	if mode != types.OneWay && mode != types.Hedge {
+		return errors.New("unknown position mode: " + string(mode))
+	}
+	if _, err := u.db.Exec("UPDATE users SET position_mode = $1 WHERE id = $2", mode, user.ID); err != nil {
+		return err
+	}
+	user.PositionMode = mode
+	return nil
+}
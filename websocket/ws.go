@@ -8,6 +8,8 @@ import (
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/xhcdpg/crypto-trade/instrument"
+	"github.com/xhcdpg/crypto-trade/matching"
 	"github.com/xhcdpg/crypto-trade/models"
 	"github.com/xhcdpg/crypto-trade/user"
 	"log"
@@ -18,11 +20,13 @@ type WebsocketService struct {
 	clients     map[*websocket.Conn]string // conn -> userID
 	clientMu    sync.Mutex
 	userService *user.UserService
+	instruments *instrument.Registry
+	matching    *matching.MatchingEngine
 	publisher   message.Publisher
 	subscriber  message.Subscriber
 }
 
-func NewWebsocketService(publisher message.Publisher, amqpURI string) *WebsocketService {
+func NewWebsocketService(publisher message.Publisher, amqpURI string, instruments *instrument.Registry, matching *matching.MatchingEngine) *WebsocketService {
 	logger := watermill.NewStdLogger(false, false)
 	amqpConfig := amqp.NewDurablePubSubConfig(amqpURI, nil)
 	subscriber, err := amqp.NewSubscriber(amqpConfig, logger)
@@ -30,9 +34,11 @@ func NewWebsocketService(publisher message.Publisher, amqpURI string) *Websocket
 		log.Fatal("failed to create amqp subscriber", err)
 	}
 	return &WebsocketService{
-		clients:    make(map[*websocket.Conn]string),
-		publisher:  publisher,
-		subscriber: subscriber,
+		clients:     make(map[*websocket.Conn]string),
+		instruments: instruments,
+		matching:    matching,
+		publisher:   publisher,
+		subscriber:  subscriber,
 	}
 }
 
@@ -105,6 +111,55 @@ func (ws *WebsocketService) HandleConnection(conn *websocket.Conn) {
 				"message": "subscribe success",
 				"topic":   payload.Topic,
 			})
+		case "instruments":
+			conn.WriteJSON(gin.H{
+				"message":     "instruments",
+				"instruments": ws.instruments.List(),
+			})
+		case "depth":
+			var payload struct {
+				Symbol string `json:"symbol"`
+				Levels int    `json:"levels"`
+				Orders bool   `json:"orders"` // true for L3
+			}
+			if err := decodePayload(msg.Payload, &payload); err != nil {
+				conn.WriteJSON(gin.H{"error": "invalid payload"})
+				continue
+			}
+			var (
+				depth interface{}
+				err   error
+			)
+			if payload.Orders {
+				depth, err = ws.matching.GetOrderDepth(payload.Symbol, payload.Levels)
+			} else {
+				depth, err = ws.matching.GetDepth(payload.Symbol, payload.Levels)
+			}
+			if err != nil {
+				conn.WriteJSON(gin.H{"error": err.Error()})
+				continue
+			}
+			conn.WriteJSON(gin.H{
+				"message": "depth",
+				"depth":   depth,
+			})
+		case "ticker":
+			var payload struct {
+				Symbol string `json:"symbol"`
+			}
+			if err := decodePayload(msg.Payload, &payload); err != nil {
+				conn.WriteJSON(gin.H{"error": "invalid payload"})
+				continue
+			}
+			ticker, err := ws.matching.GetBookTicker(payload.Symbol)
+			if err != nil {
+				conn.WriteJSON(gin.H{"error": err.Error()})
+				continue
+			}
+			conn.WriteJSON(gin.H{
+				"message": "ticker",
+				"ticker":  ticker,
+			})
 		case "ping":
 			conn.WriteJSON(gin.H{"message": "pong"})
 		default:
@@ -112,3 +167,15 @@ func (ws *WebsocketService) HandleConnection(conn *websocket.Conn) {
 		}
 	}
 }
+
+// decodePayload accepts a payload sent either as a JSON string or as a JSON object.
+func decodePayload(payload interface{}, v interface{}) error {
+	if str, ok := payload.(string); ok {
+		return json.Unmarshal([]byte(str), v)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}